@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"github.com/Luzifer/go_helpers/v2/cli"
+)
+
+func init() {
+	registry.Add(cli.RegistryEntry{
+		Description: "Remove all managed chains and the jumps to them",
+		Name:        "cleanup",
+		Run: func([]string) error {
+			confFile, err := config.Load(cfg.Config)
+			if err != nil {
+				return fmt.Errorf("loading config file: %w", err)
+			}
+
+			be, err := backend.ByName(confFile.Backend, confFile.ManagedChain)
+			if err != nil {
+				return fmt.Errorf("creating rule backend: %w", err)
+			}
+
+			if err = be.Cleanup(); err != nil {
+				return fmt.Errorf("removing managed chains: %w", err)
+			}
+
+			return nil
+		},
+	})
+}
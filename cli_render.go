@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/memory"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/servicemonitor"
+	"github.com/Luzifer/go_helpers/v2/cli"
+)
+
+func init() {
+	registry.Add(cli.RegistryEntry{
+		Description: "Print the rules generated for the given (default: all) services / targets deemed healthy",
+		Name:        "render",
+		Params:      []string{"[service[/addr:port]]", "..."},
+		Run: func(args []string) error {
+			confFile, err := config.Load(cfg.Config)
+			if err != nil {
+				return fmt.Errorf("loading config file: %w", err)
+			}
+
+			mem := memory.New(nil)
+			for _, s := range confFile.Services {
+				for _, t := range s.Targets {
+					if !renderTargetSelected(args[1:], s, t) {
+						continue
+					}
+
+					for _, nt := range servicemonitor.NATTargets(s, t) {
+						mem.RegisterServiceTarget(s.Name, nt)
+					}
+				}
+			}
+
+			rules, err := backend.Render(confFile.Backend, confFile.ManagedChain, mem)
+			if err != nil {
+				return fmt.Errorf("rendering rules: %w", err)
+			}
+
+			if _, err = os.Stdout.Write(rules); err != nil {
+				return fmt.Errorf("writing rules: %w", err)
+			}
+
+			return nil
+		},
+	})
+}
+
+func renderTargetSelected(selectors []string, s config.Service, t config.Target) bool {
+	if len(selectors) == 0 {
+		return true
+	}
+
+	for _, sel := range selectors {
+		svc, tgt, hasTgt := strings.Cut(sel, "/")
+		if svc != s.Name {
+			continue
+		}
+
+		if !hasTgt || tgt == t.String() {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/servicemonitor"
+	"github.com/Luzifer/go_helpers/v2/cli"
+)
+
+const targetStateTimeout = 5 * time.Second
+
+func init() {
+	registry.Add(cli.RegistryEntry{
+		Description: "Set the state of a target in the running daemon through the --admin-socket",
+		Name:        "target-state",
+		Params:      []string{"<service>", "<addr:port>", "<enable|drain|disable>"},
+		Run: func(args []string) error {
+			if len(args[1:]) < 3 { //nolint:mnd // Number of parameters
+				return fmt.Errorf("usage: target-state <service> <addr:port> <enable|drain|disable>")
+			}
+
+			state, ok := map[string]string{
+				"disable": servicemonitor.AdminStateDisabled,
+				"drain":   servicemonitor.AdminStateDrained,
+				"enable":  servicemonitor.AdminStateEnabled,
+			}[args[3]]
+			if !ok {
+				return fmt.Errorf("unknown state %q", args[3])
+			}
+
+			return setTargetState(args[1], args[2], state)
+		},
+	})
+}
+
+func setTargetState(service, target, state string) error {
+	if cfg.AdminSocket == "" {
+		return fmt.Errorf("admin socket of the daemon must be set")
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", cfg.AdminSocket)
+			},
+		},
+	}
+
+	u := url.URL{
+		Scheme: "http",
+		// Host is ignored as the connection is made to the socket
+		Host: "ipt-loadbalancer",
+		Path: strings.Join([]string{"/api/state", service, target}, "/"),
+	}
+
+	body, err := json.Marshal(map[string]string{"state": state})
+	if err != nil {
+		return fmt.Errorf("encoding payload: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), targetStateTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("executing request: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusNoContent {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
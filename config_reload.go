@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/servicemonitor"
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+const configChangeDebounce = 500 * time.Millisecond
+
+// reloadConfig loads the config file and applies the changed services
+// to the manager. In case the config cannot be loaded or contains
+// services the manager cannot start the current config is kept and
+// returned.
+func reloadConfig(mgr *servicemonitor.Manager, current config.File) config.File {
+	confFile, err := config.Load(cfg.Config)
+	if err != nil {
+		logrus.WithError(err).Error("reloading config file, keeping current config")
+		return current
+	}
+
+	if confFile.Backend != current.Backend || confFile.ManagedChain != current.ManagedChain {
+		logrus.Warn("backend and managedChain cannot be changed at runtime, restart required")
+		confFile.Backend, confFile.ManagedChain = current.Backend, current.ManagedChain
+	}
+
+	if err = mgr.Apply(confFile.Services); err != nil {
+		if errors.Is(err, servicemonitor.ErrInvalidService) {
+			logrus.WithError(err).Error("validating reloaded config, keeping current config")
+			return current
+		}
+		logrus.WithError(err).Error("applying reloaded config")
+	}
+
+	logrus.WithField("services", len(confFile.Services)).Info("config reloaded")
+	return confFile
+}
+
+// watchConfig watches the directory of the given config file (editors
+// tend to replace files instead of writing them) and notifies through
+// the returned channel when the file was changed
+func watchConfig(fn string) (<-chan struct{}, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("creating watcher: %w", err)
+	}
+
+	fn = filepath.Clean(fn)
+	if err = watcher.Add(filepath.Dir(fn)); err != nil {
+		return nil, fmt.Errorf("watching config directory: %w", err)
+	}
+
+	var (
+		changed  = make(chan struct{}, 1)
+		debounce = time.NewTimer(configChangeDebounce)
+	)
+	debounce.Stop()
+
+	go func() {
+		for {
+			select {
+			case evt := <-watcher.Events:
+				if filepath.Clean(evt.Name) != fn || evt.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename) == 0 {
+					continue
+				}
+				debounce.Reset(configChangeDebounce)
+
+			case err := <-watcher.Errors:
+				logrus.WithError(err).Error("watching config file")
+
+			case <-debounce.C:
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return changed, nil
+}
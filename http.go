@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/servicemonitor"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	adminSocketMode       = 0o600
+	httpReadHeaderTimeout = 5 * time.Second
+)
+
+func startHTTPServer(addr string, mgr *servicemonitor.Manager) error {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+
+	mux.HandleFunc("GET /api/status", func(w http.ResponseWriter, _ *http.Request) {
+		sendJSON(w, http.StatusOK, mgr.Status())
+	})
+
+	mux.HandleFunc("GET /api/status/{service}", func(w http.ResponseWriter, r *http.Request) {
+		status, ok := mgr.ServiceStatus(r.PathValue("service"))
+		if !ok {
+			http.Error(w, "service not found", http.StatusNotFound)
+			return
+		}
+
+		sendJSON(w, http.StatusOK, status)
+	})
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+	}
+
+	if err := server.ListenAndServe(); err != nil {
+		return fmt.Errorf("listening for HTTP traffic: %w", err)
+	}
+
+	return nil
+}
+
+// startAdminServer serves the endpoints changing the state of the
+// daemon on a unix socket only accessible by the user running the
+// daemon so they are not exposed together with the metrics
+func startAdminServer(socket string, mgr *servicemonitor.Manager) error {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("PUT /api/state/{service}/{target}", func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			State string `json:"state"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "invalid payload", http.StatusBadRequest)
+			return
+		}
+
+		err := mgr.SetTargetState(r.PathValue("service"), r.PathValue("target"), payload.State)
+		switch {
+		case err == nil:
+			w.WriteHeader(http.StatusNoContent)
+
+		case errors.Is(err, servicemonitor.ErrUnknownState):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+		case errors.Is(err, servicemonitor.ErrServiceNotFound), errors.Is(err, servicemonitor.ErrTargetNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+
+		default:
+			logrus.WithError(err).Error("setting target state")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+
+	if conn, err := net.Dial("unix", socket); err == nil {
+		conn.Close() //nolint:errcheck,gosec // Only used to probe the socket
+		return fmt.Errorf("admin socket %q is in use by another process", socket)
+	}
+
+	// Remove the socket left over by a previous run
+	if err := os.Remove(socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("removing stale admin socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return fmt.Errorf("listening on admin socket: %w", err)
+	}
+
+	if err = os.Chmod(socket, adminSocketMode); err != nil {
+		return fmt.Errorf("restricting admin socket permissions: %w", err)
+	}
+
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+	}
+
+	if err = server.Serve(listener); err != nil {
+		return fmt.Errorf("serving admin API: %w", err)
+	}
+
+	return nil
+}
+
+func sendJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		logrus.WithError(err).Error("encoding JSON response")
+	}
+}
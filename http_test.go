@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/memory"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/servicemonitor"
+	"github.com/Luzifer/go_helpers/v2/fieldcollection"
+	"github.com/sirupsen/logrus"
+)
+
+func TestAdminServerSetTargetState(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	states, err := servicemonitor.NewAdminStateStore("")
+	if err != nil {
+		t.Fatalf("creating state store: %s", err)
+	}
+
+	mgr := servicemonitor.NewManager(memory.New(nil), states, nil, logrus.NewEntry(logger))
+	defer mgr.Stop()
+
+	if err = mgr.Apply([]config.Service{{
+		Name:     "web",
+		BindAddr: "10.0.0.1",
+		BindPort: 80,
+		HealthCheck: config.ServiceHealthCheck{
+			Type:     "tcp",
+			Interval: time.Hour,
+			Settings: fieldcollection.NewFieldCollection(),
+		},
+		Targets: []config.Target{{Addr: "127.0.0.1", LocalAddr: "127.0.0.1", Port: 1, Weight: 1}},
+	}}); err != nil {
+		t.Fatalf("applying services: %s", err)
+	}
+
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	go func() {
+		if err := startAdminServer(socket, mgr); err != nil {
+			t.Errorf("serving admin API: %s", err)
+		}
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		path, body string
+		status     int
+	}{
+		{"/api/state/web/127.0.0.1:1", `{"state": "drained"}`, http.StatusNoContent},
+		{"/api/state/web/127.0.0.1:1", `{"state": "drain"}`, http.StatusBadRequest},
+		{"/api/state/web/127.0.0.1:1", `{"state"`, http.StatusBadRequest},
+		{"/api/state/web/127.0.0.1:2", `{"state": "drained"}`, http.StatusNotFound},
+		{"/api/state/api/127.0.0.1:1", `{"state": "drained"}`, http.StatusNotFound},
+	} {
+		var resp *http.Response
+
+		// Wait for the server to listen on the socket
+		for i := 0; i < 50; i++ {
+			req, _ := http.NewRequestWithContext(context.Background(), http.MethodPut, "http://admin"+tc.path, strings.NewReader(tc.body))
+			if resp, err = client.Do(req); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond) //nolint:mnd // Retry delay
+		}
+		if err != nil {
+			t.Fatalf("executing request: %s", err)
+		}
+		resp.Body.Close() //nolint:errcheck,gosec
+
+		if resp.StatusCode != tc.status {
+			t.Errorf("PUT %s %s: expected status %d, got %d", tc.path, tc.body, tc.status, resp.StatusCode)
+		}
+	}
+
+	if state := states.Get("web", "127.0.0.1:1"); state != servicemonitor.AdminStateDrained {
+		t.Errorf("expected target to be drained, got %q", state)
+	}
+}
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/common"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/memory"
 	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
-	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/iptables"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/conntrack"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/metrics"
 	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/servicemonitor"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -15,10 +22,16 @@ import (
 
 var (
 	cfg = struct {
+		AdminSocket        string `flag:"admin-socket" default:"/run/ipt-loadbalancer.sock" description:"Unix socket to serve the admin API changing target states on (empty to disable)"`
 		Config             string `flag:"config,c" default:"config.yaml" description:"Configuration file to load"`
+		DryRun             bool   `flag:"dry-run,n" default:"false" description:"Print the generated rules instead of applying them"`
 		EnableManagedChain bool   `flag:"enable-managed-chain,e" default:"false" description:"Modify PREROUTING / POSTROUTING chain to contain a jump to managed chain"`
+		Listen             string `flag:"listen" default:"" description:"Address to listen on for the metrics and status API endpoints (empty to disable)"`
 		LogLevel           string `flag:"log-level" default:"info" description:"Log level (debug, info, warn, error, fatal)"`
+		ShutdownPolicy     string `flag:"shutdown-policy" default:"leave" description:"What to do with the rules on shutdown (leave, freeze, remove)"`
+		StateFile          string `flag:"state-file" default:"/var/lib/ipt-loadbalancer/states.json" description:"File to persist the target states set by the operator to (empty to keep them in memory)"`
 		VersionAndExit     bool   `flag:"version" default:"false" description:"Prints current version and exits"`
+		WatchConfig        bool   `flag:"watch-config,w" default:"false" description:"Reload the configuration file when it changes (reload is always possible using SIGHUP)"`
 	}{}
 
 	registry = cli.New()
@@ -31,6 +44,12 @@ func initApp() error {
 		return errors.Wrap(err, "parsing cli options")
 	}
 
+	switch cfg.ShutdownPolicy {
+	case shutdownPolicyFreeze, shutdownPolicyLeave, shutdownPolicyRemove:
+	default:
+		return fmt.Errorf("unknown shutdown-policy %q", cfg.ShutdownPolicy)
+	}
+
 	l, err := logrus.ParseLevel(cfg.LogLevel)
 	if err != nil {
 		return errors.Wrap(err, "parsing log-level")
@@ -66,27 +85,69 @@ func main() {
 		logrus.WithError(err).Fatal("loading config file")
 	}
 
-	ipt, err := iptables.New(confFile.ManagedChain)
-	if err != nil {
-		logrus.WithError(err).Fatal("creating iptables client")
+	var be backend.Backend
+	if cfg.DryRun {
+		be = memory.New(func(src common.TargetSource) error {
+			rules, err := backend.Render(confFile.Backend, confFile.ManagedChain, src)
+			if err != nil {
+				return fmt.Errorf("rendering rules: %w", err)
+			}
+
+			_, err = os.Stdout.Write(rules)
+			return err
+		})
+	} else if be, err = backend.ByName(confFile.Backend, confFile.ManagedChain); err != nil {
+		logrus.WithError(err).Fatal("creating rule backend")
 	}
 
-	if err = ipt.EnsureManagedChains(); err != nil {
+	be = metrics.InstrumentBackend(be)
+
+	if err = be.EnsureManagedChains(); err != nil {
 		logrus.WithError(err).Fatal("creating managed chain")
 	}
 
 	if cfg.EnableManagedChain {
-		if err = ipt.EnableMangedRoutingChains(); err != nil {
+		if err = be.EnableMangedRoutingChains(); err != nil {
 			logrus.WithError(err).Fatal("enabling routing")
 		}
 	}
 
-	svcErr := make(chan error, 1)
-	for i := range confFile.Services {
-		s := confFile.Services[i]
+	// A dry-run must neither touch the state of the daemon nor require
+	// access to its files
+	stateFile := cfg.StateFile
+	if cfg.DryRun {
+		stateFile = ""
+	}
+
+	states, err := servicemonitor.NewAdminStateStore(stateFile)
+	if err != nil {
+		logrus.WithError(err).Fatal("loading target states")
+	}
 
-		sMon := servicemonitor.New(ipt, logrus.WithField("service", s.Name), s)
-		go func() { svcErr <- sMon.Run() }()
+	var ct conntrack.Table = conntrack.NewCLI()
+	if cfg.DryRun {
+		ct = conntrack.NewFake()
+	}
+
+	mgr := servicemonitor.NewManager(be, states, ct, logrus.NewEntry(logrus.StandardLogger()))
+	if err = mgr.Apply(confFile.Services); err != nil {
+		logrus.WithError(err).Fatal("starting service monitors")
+	}
+
+	if cfg.Listen != "" {
+		go func() {
+			if err := startHTTPServer(cfg.Listen, mgr); err != nil {
+				logrus.WithError(err).Fatal("HTTP server caused error")
+			}
+		}()
+	}
+
+	if cfg.AdminSocket != "" && !cfg.DryRun {
+		go func() {
+			if err := startAdminServer(cfg.AdminSocket, mgr); err != nil {
+				logrus.WithError(err).Warn("admin server caused error, target states cannot be changed")
+			}
+		}()
 	}
 
 	logrus.WithFields(logrus.Fields{
@@ -94,11 +155,38 @@ func main() {
 		"version":  version,
 	}).Info("ipt-loadbalancer started")
 
-	for err := range svcErr {
-		if err == nil {
-			continue
+	sigHUP := make(chan os.Signal, 1)
+	signal.Notify(sigHUP, syscall.SIGHUP)
+
+	sigTerm := make(chan os.Signal, 1)
+	signal.Notify(sigTerm, syscall.SIGINT, syscall.SIGTERM)
+
+	var cfgChange <-chan struct{}
+	if cfg.WatchConfig {
+		if cfgChange, err = watchConfig(cfg.Config); err != nil {
+			logrus.WithError(err).Fatal("watching config file")
 		}
+	}
 
-		logrus.WithError(err).Fatal("service monitor caused error")
+	for {
+		select {
+		case err = <-mgr.Errors():
+			logrus.WithError(err).Fatal("service monitor caused error")
+
+		case <-sigHUP:
+			confFile = reloadConfig(mgr, confFile)
+
+		case <-cfgChange:
+			confFile = reloadConfig(mgr, confFile)
+
+		case sig := <-sigTerm:
+			logrus.WithField("signal", sig).Info("shutting down")
+			mgr.Stop()
+
+			if err = shutdown(be, cfg.ShutdownPolicy); err != nil {
+				logrus.WithError(err).Fatal("applying shutdown policy")
+			}
+			return
+		}
 	}
 }
@@ -0,0 +1,449 @@
+// Package common contains the types and helpers shared between the
+// rule backends
+package common
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/hashstructure/v2"
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	// NATTarget contains the configuration for a DNAT jump target
+	// with random distribution and given probability
+	NATTarget struct {
+		Addr            string
+		AffinityTimeout time.Duration
+		Balance         string
+		BindAddr        string
+		BindPort        int
+		Family          string
+		LocalAddr       string
+		Port            int
+		Priority        int
+		Proto           string
+		Weight          float64
+	}
+
+	// ServiceRegistry keeps track of the targets registered for each
+	// service and is meant to be embedded into the backends
+	ServiceRegistry struct {
+		lock     sync.RWMutex
+		lastGood map[string][]NATTarget
+		removed  map[string]bool
+		services map[string][]NATTarget
+	}
+
+	// TargetSource provides read access to the targets registered
+	// for each service and is used to render the rulesets
+	TargetSource interface {
+		RemovedServices() []string
+		ServiceNames() []string
+		ServiceTargets(service string) []NATTarget
+	}
+
+	// ServiceRule contains the resolved addresses of a NATTarget
+	// together with the probability it should be chosen in the
+	// service chain
+	ServiceRule struct {
+		AffinityTimeout time.Duration
+		Balance         string
+		BindAddr        string
+		BindPort        int
+		LocalAddr       string
+		Probability     float64
+		Proto           string
+		TargetAddr      string
+		TargetPort      int
+		Weight          int
+	}
+
+	// RoundRobinSlot is one connection within a round of the round-
+	// robin distribution: the slot is to be matched by one of Every
+	// connections reaching it
+	RoundRobinSlot struct {
+		ServiceRule
+		Every int
+	}
+)
+
+// Modes to balance the connections between the targets, the random
+// mode is used when none is given
+const (
+	BalanceRandom     = "random"
+	BalanceRoundRobin = "roundrobin"
+	BalanceSourceIP   = "sourceip"
+)
+
+// Address families the targets are routed in
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// Families contains all supported address families in the order
+// they are rendered
+var Families = []string{FamilyIPv4, FamilyIPv6}
+
+var disallowedChars = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// ActiveTier returns the targets of the highest priority (lowest
+// priority value) present in the given targets: lower priority tiers
+// only receive traffic when no target of a higher tier is registered
+func ActiveTier(targets []NATTarget) (active []NATTarget) {
+	for _, t := range targets {
+		switch {
+		case len(active) == 0 || t.Priority < active[0].Priority:
+			active = []NATTarget{t}
+		case t.Priority == active[0].Priority:
+			active = append(active, t)
+		}
+	}
+
+	return active
+}
+
+// AddrFamily returns the address family of the given IP address or
+// an empty string if the address is no IP (i.e. a hostname)
+func AddrFamily(addr string) string {
+	ip := net.ParseIP(addr)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return FamilyIPv4
+	default:
+		return FamilyIPv6
+	}
+}
+
+// BuildServiceRules resolves the addresses of the targets in the
+// active priority tier and calculates the probability for each of
+// them to be chosen when evaluated in order. Targets which cannot be
+// resolved are skipped and do not take part in the distribution.
+func BuildServiceRules(targets []NATTarget) (rules []ServiceRule) {
+	var (
+		weightLeft float64
+		weights    []float64
+	)
+
+	for _, nt := range ActiveTier(targets) {
+		var (
+			bindAddr, localAddr, targetAddr string
+			err                             error
+		)
+
+		if bindAddr, err = TranslateToIP(nt.BindAddr, nt.Family); err != nil {
+			logrus.WithError(err).WithField("bind_addr", nt.BindAddr).Error("invalid address")
+			continue
+		}
+
+		if targetAddr, err = TranslateToIP(nt.Addr, nt.Family); err != nil {
+			logrus.WithError(err).WithField("target_addr", nt.Addr).Error("invalid address")
+			continue
+		}
+
+		if localAddr, err = TranslateToIP(nt.LocalAddr, nt.Family); err != nil {
+			logrus.WithError(err).WithField("local_addr", nt.LocalAddr).Error("invalid address")
+			continue
+		}
+
+		rules = append(rules, ServiceRule{
+			AffinityTimeout: nt.AffinityTimeout,
+			Balance:         nt.Balance,
+			BindAddr:        bindAddr,
+			BindPort:        nt.BindPort,
+			LocalAddr:       localAddr,
+			Proto:           nt.Proto,
+			TargetAddr:      targetAddr,
+			TargetPort:      nt.Port,
+			Weight:          int(math.Round(nt.Weight)),
+		})
+
+		weights = append(weights, nt.Weight)
+		weightLeft += nt.Weight
+	}
+
+	for i := range rules {
+		rules[i].Probability = weights[i] / weightLeft
+		weightLeft -= weights[i]
+	}
+
+	return rules
+}
+
+// ChainName joins the given components into a chain name containing
+// only characters safe to use in iptables / nftables chain names
+func ChainName(components ...string) string {
+	var parts []string
+	for _, c := range components {
+		parts = append(parts, disallowedChars.ReplaceAllString(strings.ToUpper(c), "_"))
+	}
+
+	return strings.Join(parts, "_")
+}
+
+// FilterFamily returns the targets routed in the given address family
+func FilterFamily(targets []NATTarget, family string) (filtered []NATTarget) {
+	for _, t := range targets {
+		if t.Family == family {
+			filtered = append(filtered, t)
+		}
+	}
+
+	return filtered
+}
+
+// RoundRobinSlots distributes the connections of one round between
+// the given rules according to their weights (reduced by their
+// greatest common divisor) and interleaves the targets as evenly as
+// possible. When evaluated in order each slot matches exactly one
+// connection per round as it matches one of Every connections
+// reaching it.
+func RoundRobinSlots(rules []ServiceRule) (slots []RoundRobinSlot) {
+	var (
+		candidates []ServiceRule
+		divisor    int
+		total      int
+	)
+
+	for _, sr := range rules {
+		if sr.Weight < 1 {
+			continue
+		}
+
+		candidates = append(candidates, sr)
+		divisor = gcd(divisor, sr.Weight)
+	}
+
+	for i := range candidates {
+		candidates[i].Weight /= divisor
+		total += candidates[i].Weight
+	}
+
+	// Smooth weighted round-robin: the candidate with the highest
+	// current weight gets the slot and is set back by the total
+	current := make([]int, len(candidates))
+	for len(slots) < total {
+		best := 0
+		for i, sr := range candidates {
+			current[i] += sr.Weight
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+
+		current[best] -= total
+		slots = append(slots, RoundRobinSlot{ServiceRule: candidates[best], Every: total - len(slots)})
+	}
+
+	return slots
+}
+
+// TranslateToIP returns the given address if it is an IP of the
+// given family or resolves the hostname and returns the first IP of
+// the given family found for it. An empty family accepts any IP.
+func TranslateToIP(addr, family string) (string, error) {
+	ip := net.ParseIP(addr)
+	if ip != nil {
+		// We got either valid IPv4 or IPv6: Just return that if the
+		// family matches.
+		if family != "" && AddrFamily(addr) != family {
+			return "", fmt.Errorf("address %q is not of family %s", addr, family)
+		}
+		return ip.String(), nil
+	}
+
+	// Was no IP, might be a hostname: Look it up
+	ips, err := net.LookupIP(addr)
+	if err != nil {
+		// Definitely was none.
+		return "", fmt.Errorf("resolving %q to ip: %w", addr, err)
+	}
+
+	for _, ip := range ips {
+		if family == "" || AddrFamily(ip.String()) == family {
+			// Had one or more addresses, we take the first one
+			return ip.String(), nil
+		}
+	}
+
+	// Maybe was one but had no addresses (of that family).
+	return "", fmt.Errorf("resolving %q did not yield IPs of family %q", addr, family)
+}
+
+// ForgetRemovedServices clears the given services from the list of
+// removed services after their chains have been deleted
+func (r *ServiceRegistry) ForgetRemovedServices(services []string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, s := range services {
+		delete(r.removed, s)
+	}
+}
+
+// RegisterServiceTarget adds a new routing target to the given service
+func (r *ServiceRegistry) RegisterServiceTarget(service string, t NATTarget) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.services == nil {
+		r.services = make(map[string][]NATTarget)
+	}
+	delete(r.removed, service)
+
+	var found bool
+	for _, et := range r.services[service] {
+		found = found || et.equals(t)
+	}
+
+	if !found {
+		r.services[service] = append(r.services[service], t)
+		r.updateLastGood(service)
+		return true
+	}
+
+	return false
+}
+
+// RemoveService removes the service and all its targets from the
+// registry and marks its chains for deletion
+func (r *ServiceRegistry) RemoveService(service string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.services[service]; !ok {
+		return false
+	}
+
+	if r.removed == nil {
+		r.removed = make(map[string]bool)
+	}
+
+	delete(r.lastGood, service)
+	delete(r.services, service)
+	r.removed[service] = true
+	return true
+}
+
+// RemovedServices returns the sorted names of all services removed
+// from the registry whose chains are still to be deleted
+func (r *ServiceRegistry) RemovedServices() (names []string) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for s := range r.removed {
+		names = append(names, s)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// RestoreLastKnownGood re-registers the targets last seen for each
+// service currently having no targets registered. This is used to
+// freeze the rules in a state not blackholing the services.
+func (r *ServiceRegistry) RestoreLastKnownGood() (changed bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for s, targets := range r.services {
+		if len(targets) > 0 || len(r.lastGood[s]) == 0 {
+			continue
+		}
+
+		r.services[s] = append([]NATTarget(nil), r.lastGood[s]...)
+		changed = true
+	}
+
+	return changed
+}
+
+// ServiceNames returns the sorted names of all services known to
+// the registry
+func (r *ServiceRegistry) ServiceNames() (names []string) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for s := range r.services {
+		names = append(names, s)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// ServiceTargets returns a copy of the targets currently registered
+// for the given service
+func (r *ServiceRegistry) ServiceTargets(service string) []NATTarget {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return append([]NATTarget(nil), r.services[service]...)
+}
+
+// UnregisterServiceTarget removes a routing target from the given service
+func (r *ServiceRegistry) UnregisterServiceTarget(service string, t NATTarget) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var tmp []NATTarget
+	for _, et := range r.services[service] {
+		if !et.equals(t) {
+			tmp = append(tmp, et)
+		}
+	}
+
+	if len(tmp) == len(r.services[service]) {
+		return false
+	}
+
+	r.services[service] = tmp
+	r.updateLastGood(service)
+	return true
+}
+
+func (r *ServiceRegistry) updateLastGood(service string) {
+	if len(r.services[service]) == 0 {
+		return
+	}
+
+	if r.lastGood == nil {
+		r.lastGood = make(map[string][]NATTarget)
+	}
+
+	r.lastGood[service] = append([]NATTarget(nil), r.services[service]...)
+}
+
+// String returns the target address and port in host:port notation
+func (n NATTarget) String() string { return net.JoinHostPort(n.Addr, strconv.Itoa(n.Port)) }
+
+func (n NATTarget) equals(c NATTarget) bool {
+	nh, _ := hashstructure.Hash(n, hashstructure.FormatV2, nil)
+	ch, _ := hashstructure.Hash(c, hashstructure.FormatV2, nil)
+
+	return nh == ch
+}
+
+// AffinityName returns the name of the list of client addresses
+// pinned to the target of the rule when balancing by source IP
+func (s ServiceRule) AffinityName() string {
+	return ChainName("AFF", s.BindAddr, strconv.Itoa(s.BindPort), s.TargetAddr, strconv.Itoa(s.TargetPort))
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
@@ -0,0 +1,69 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRoundRobinSlots(t *testing.T) {
+	rules := func(weights ...int) (rules []ServiceRule) {
+		for i, w := range weights {
+			rules = append(rules, ServiceRule{TargetAddr: fmt.Sprintf("10.1.0.%d", i+1), Weight: w})
+		}
+		return rules
+	}
+
+	for _, tc := range []struct {
+		name    string
+		weights []int
+		slots   []string
+	}{
+		{
+			name:    "equal weights",
+			weights: []int{1, 1, 1},
+			slots:   []string{"10.1.0.1/3", "10.1.0.2/2", "10.1.0.3/1"},
+		},
+		{
+			name:    "interleaved weights",
+			weights: []int{3, 1, 2},
+			slots:   []string{"10.1.0.1/6", "10.1.0.3/5", "10.1.0.1/4", "10.1.0.2/3", "10.1.0.3/2", "10.1.0.1/1"},
+		},
+		{
+			name:    "reduced by gcd",
+			weights: []int{4, 2, 6},
+			slots:   []string{"10.1.0.3/6", "10.1.0.1/5", "10.1.0.2/4", "10.1.0.3/3", "10.1.0.1/2", "10.1.0.3/1"},
+		},
+		{
+			name:    "weight 0 skipped",
+			weights: []int{2, 0, 2},
+			slots:   []string{"10.1.0.1/2", "10.1.0.3/1"},
+		},
+		{
+			name:    "no weights",
+			weights: []int{0, 0},
+		},
+	} {
+		var slots []string
+		for _, s := range RoundRobinSlots(rules(tc.weights...)) {
+			slots = append(slots, fmt.Sprintf("%s/%d", s.TargetAddr, s.Every))
+		}
+
+		if strings.Join(slots, " ") != strings.Join(tc.slots, " ") {
+			t.Errorf("%s: unexpected slots %v, expected %v", tc.name, slots, tc.slots)
+		}
+	}
+}
+
+func TestTestRegistry(t *testing.T) {
+	targets := TestRegistry(BalanceRandom, 1, 2, 3, 4, 5).ServiceTargets("web")
+	if len(targets) != 5 { //nolint:mnd // Number of weights
+		t.Fatalf("expected 5 targets, got %d", len(targets))
+	}
+
+	for i, nt := range targets {
+		if addr := fmt.Sprintf("10.1.0.%d", i+1); nt.Addr != addr || nt.Weight != float64(i+1) {
+			t.Errorf("expected target %d to be %s with weight %d, got %s with weight %v", i, addr, i+1, nt.Addr, nt.Weight)
+		}
+	}
+}
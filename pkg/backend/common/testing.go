@@ -0,0 +1,35 @@
+package common
+
+import (
+	"net/netip"
+	"time"
+)
+
+// TestRegistry creates a registry for the rendering tests of the
+// backends holding one target of the "web" service bound to
+// 10.0.0.1:80 per given weight. The targets are addressed 10.1.0.1,
+// 10.1.0.2, … in the order of the weights.
+func TestRegistry(balance string, weights ...float64) *ServiceRegistry {
+	var (
+		addr = netip.MustParseAddr("10.1.0.1")
+		reg  = new(ServiceRegistry)
+	)
+
+	for _, w := range weights {
+		reg.RegisterServiceTarget("web", NATTarget{
+			Addr:            addr.String(),
+			AffinityTimeout: time.Hour,
+			Balance:         balance,
+			BindAddr:        "10.0.0.1",
+			BindPort:        80,
+			Family:          FamilyIPv4,
+			LocalAddr:       "10.1.0.254",
+			Port:            8080,
+			Proto:           "tcp",
+			Weight:          w,
+		})
+		addr = addr.Next()
+	}
+
+	return reg
+}
@@ -0,0 +1,518 @@
+// Package iptables contains the logic to interact with the iptables
+// system interface
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/common"
+	coreosIptables "github.com/coreos/go-iptables/iptables"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	natTable      = "nat"
+	probBitsize   = 64
+	probPrecision = 3
+)
+
+type (
+	// Client contains the required functions to create the loadbalancing
+	Client struct {
+		common.ServiceRegistry
+
+		applyLock    sync.Mutex
+		applied      map[string][]byte
+		families     []familyClient
+		managedChain string
+
+		rulesLock sync.RWMutex
+		rules     map[string][]string
+	}
+
+	// familyClient bundles the iptables / ip6tables client and the
+	// matching restore binary for one address family
+	familyClient struct {
+		*coreosIptables.IPTables
+
+		family      string
+		restorePath string
+	}
+
+	chainType uint
+)
+
+const (
+	chainTypeDNAT chainType = iota
+	chainTypeSNAT
+)
+
+// New creates a new IPTables client. IPv4 support is required while
+// IPv6 support is only enabled when ip6tables is available.
+func New(managedChain string) (c *Client, err error) {
+	c = &Client{
+		applied:      make(map[string][]byte),
+		managedChain: managedChain,
+	}
+
+	v4, err := newFamilyClient(common.FamilyIPv4, coreosIptables.ProtocolIPv4, "iptables-restore")
+	if err != nil {
+		return nil, err
+	}
+	c.families = append(c.families, v4)
+
+	v6, err := newFamilyClient(common.FamilyIPv6, coreosIptables.ProtocolIPv6, "ip6tables-restore")
+	if err != nil {
+		logrus.WithError(err).Warn("IPv6 support disabled")
+		return c, nil
+	}
+	c.families = append(c.families, v6)
+
+	return c, nil
+}
+
+// EnsureManagedChains creates the managed chain referring to the
+// service chains while only leading the specified address / port
+// to that service chain. All chains of one address family are
+// replaced within one iptables-restore transaction so the previous
+// ruleset stays intact in case the new one cannot be committed. The
+// rulesets of all families are tested before committing any of them
+// and if committing one of them still fails the families already
+// committed are rolled back to their previous ruleset.
+func (c *Client) EnsureManagedChains() (err error) {
+	c.applyLock.Lock()
+	defer c.applyLock.Unlock()
+
+	removed := c.RemovedServices()
+
+	if err = c.checkFamilySupport(); err != nil {
+		return err
+	}
+
+	var (
+		rules   = make(map[string][]string)
+		scripts = make([][]byte, len(c.families))
+	)
+
+	for i, fc := range c.families {
+		script, serviceRules := render(c.managedChain, fc.family, c)
+		for s, sr := range serviceRules {
+			rules[s] = append(rules[s], sr...)
+		}
+		scripts[i] = script
+
+		if err = fc.restore(script, "--test"); err != nil {
+			return fmt.Errorf("testing %s rules: %w", fc.family, err)
+		}
+	}
+
+	for i, fc := range c.families {
+		if err = fc.restore(scripts[i]); err != nil {
+			c.rollback(scripts[:i])
+			return fmt.Errorf("applying %s rules: %w", fc.family, err)
+		}
+	}
+
+	for i, fc := range c.families {
+		c.applied[fc.family] = scripts[i]
+	}
+
+	c.rulesLock.Lock()
+	c.rules = rules
+	c.rulesLock.Unlock()
+
+	c.ForgetRemovedServices(removed)
+	return nil
+}
+
+// Cleanup removes the jumps to the managed chains from the PREROUTING
+// and POSTROUTING chains and deletes all chains having the managed
+// chain prefix in all supported address families
+func (c *Client) Cleanup() (err error) {
+	c.applyLock.Lock()
+	defer c.applyLock.Unlock()
+
+	for _, fc := range c.families {
+		if err = fc.cleanup(c.managedChain); err != nil {
+			return fmt.Errorf("cleaning up %s: %w", fc.family, err)
+		}
+	}
+
+	return nil
+}
+
+// rollback restores the previously applied rulesets of the first
+// families after the given rulesets were committed for them
+func (c *Client) rollback(committed [][]byte) {
+	for i, script := range committed {
+		fc := c.families[i]
+		logger := logrus.WithField("family", fc.family)
+
+		previous, ok := c.applied[fc.family]
+		if !ok {
+			logger.Error("no previous rules to roll back to, keeping new rules")
+			continue
+		}
+
+		if err := fc.restore(rollbackScript(previous, script)); err != nil {
+			logger.WithError(err).Error("rolling back rules")
+			continue
+		}
+
+		logger.Warn("rolled back rules")
+	}
+}
+
+func (fc familyClient) cleanup(managedChain string) (err error) {
+	if err = fc.DeleteIfExists(natTable, "PREROUTING", "-j", common.ChainName(managedChain, "DNAT")); err != nil {
+		return fmt.Errorf("removing DNAT jump to managed chain: %w", err)
+	}
+
+	if err = fc.DeleteIfExists(natTable, "POSTROUTING", "-j", common.ChainName(managedChain, "SNAT")); err != nil {
+		return fmt.Errorf("removing SNAT jump to managed chain: %w", err)
+	}
+
+	chains, err := fc.ListChains(natTable)
+	if err != nil {
+		return fmt.Errorf("listing chains: %w", err)
+	}
+
+	var managed []string
+	for _, chain := range chains {
+		if strings.HasPrefix(chain, common.ChainName(managedChain)+"_") {
+			managed = append(managed, chain)
+		}
+	}
+
+	// Chains are referencing each other so we need to flush all of
+	// them before being able to delete them
+	for _, chain := range managed {
+		if err = fc.ClearChain(natTable, chain); err != nil {
+			return fmt.Errorf("clearing chain %q: %w", chain, err)
+		}
+	}
+
+	for _, chain := range managed {
+		if err = fc.DeleteChain(natTable, chain); err != nil {
+			return fmt.Errorf("deleting chain %q: %w", chain, err)
+		}
+	}
+
+	return nil
+}
+
+// EnableMangedRoutingChains inserts a jump to the given managed chains
+// at position 1 of the PREROUTING and POSTROUTING chains if it does
+// not already exist in the chain
+func (c *Client) EnableMangedRoutingChains() (err error) {
+	for _, fc := range c.families {
+		if err = fc.enableManagedRoutingChains(c.managedChain); err != nil {
+			return fmt.Errorf("enabling %s routing: %w", fc.family, err)
+		}
+	}
+
+	return nil
+}
+
+func (fc familyClient) enableManagedRoutingChains(managedChain string) (err error) {
+	if err = fc.InsertUnique(natTable, "PREROUTING", 1, "-j", common.ChainName(managedChain, "DNAT")); err != nil {
+		return fmt.Errorf("ensuring DNAT jump to managed chain: %w", err)
+	}
+
+	if err = fc.InsertUnique(natTable, "POSTROUTING", 1, "-j", common.ChainName(managedChain, "SNAT")); err != nil {
+		return fmt.Errorf("ensuring SNAT jump to managed chain: %w", err)
+	}
+
+	return nil
+}
+
+// Render renders all managed chains for the services in the given
+// source into the iptables-restore format for the given address
+// family: when applied using --noflush only the managed chains are
+// flushed and refilled while all other chains are left untouched.
+// Chains of removed services are flushed and deleted.
+func Render(managedChain, family string, src common.TargetSource) []byte {
+	script, _ := render(managedChain, family, src)
+	return script
+}
+
+// ServiceRules returns the rules of the chains of the given service
+// as applied by the last successful EnsureManagedChains call
+func (c *Client) ServiceRules(service string) []string {
+	c.rulesLock.RLock()
+	defer c.rulesLock.RUnlock()
+
+	return append([]string(nil), c.rules[service]...)
+}
+
+// render renders the iptables-restore script and additionally returns
+// the rules of the chains of each service. Rules of the chains of
+// families other than IPv4 are only returned when the service has
+// targets in that family.
+func render(managedChain, family string, src common.TargetSource) (script []byte, serviceRules map[string][]string) {
+	var (
+		chains, stale []string
+		dnat, snat    [][]string
+		rules         = map[string][][]string{}
+	)
+
+	serviceRules = make(map[string][]string)
+
+	for _, s := range src.RemovedServices() {
+		stale = append(stale, common.ChainName(managedChain, s, "DNAT"), common.ChainName(managedChain, s, "SNAT"))
+	}
+
+	for _, s := range src.ServiceNames() {
+		targets := common.FilterFamily(src.ServiceTargets(s), family)
+
+		for _, ct := range []struct {
+			chain string
+			cType chainType
+		}{
+			{common.ChainName(managedChain, s, "DNAT"), chainTypeDNAT},
+			{common.ChainName(managedChain, s, "SNAT"), chainTypeSNAT},
+		} {
+			chains = append(chains, ct.chain)
+			rules[ct.chain] = buildServiceTable(targets, ct.cType)
+
+			if family != common.FamilyIPv4 && len(targets) == 0 {
+				continue
+			}
+
+			for _, rule := range rules[ct.chain] {
+				serviceRules[s] = append(serviceRules[s], fmt.Sprintf("-A %s %s", ct.chain, strings.Join(rule, " ")))
+			}
+		}
+
+		dnat = append(dnat, []string{"-j", common.ChainName(managedChain, s, "DNAT")})
+		snat = append(snat, []string{"-j", common.ChainName(managedChain, s, "SNAT")})
+	}
+
+	chains = append(chains, common.ChainName(managedChain, "DNAT"), common.ChainName(managedChain, "SNAT"))
+	rules[common.ChainName(managedChain, "DNAT")] = append(dnat, []string{"-j", "RETURN"})
+	rules[common.ChainName(managedChain, "SNAT")] = append(snat, []string{"-j", "RETURN"})
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "*%s\n", natTable)
+	for _, chain := range append(chains, stale...) {
+		fmt.Fprintf(buf, ":%s - [0:0]\n", chain)
+	}
+	for _, chain := range chains {
+		for _, rule := range rules[chain] {
+			fmt.Fprintf(buf, "-A %s %s\n", chain, strings.Join(rule, " "))
+		}
+	}
+	for _, chain := range stale {
+		fmt.Fprintf(buf, "-X %s\n", chain)
+	}
+	fmt.Fprintln(buf, "COMMIT")
+
+	return buf.Bytes(), serviceRules
+}
+
+// rollbackScript returns the previous script additionally deleting
+// the chains only created by the committed one: they are no longer
+// referenced after the managed chains are restored.
+func rollbackScript(previous, committed []byte) []byte {
+	known := make(map[string]bool)
+	for _, chain := range declaredChains(previous) {
+		known[chain] = true
+	}
+
+	var orphans []string
+	for _, chain := range declaredChains(committed) {
+		if !known[chain] {
+			orphans = append(orphans, chain)
+		}
+	}
+
+	if len(orphans) == 0 {
+		return previous
+	}
+
+	buf := new(bytes.Buffer)
+	for _, line := range strings.Split(strings.TrimSpace(string(previous)), "\n") {
+		if line == "COMMIT" {
+			for _, chain := range orphans {
+				fmt.Fprintf(buf, "-X %s\n", chain)
+			}
+		}
+
+		fmt.Fprintln(buf, line)
+
+		if strings.HasPrefix(line, "*") {
+			for _, chain := range orphans {
+				fmt.Fprintf(buf, ":%s - [0:0]\n", chain)
+			}
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// declaredChains returns the names of the chains declared in the
+// given iptables-restore script
+func declaredChains(script []byte) (chains []string) {
+	for _, line := range strings.Split(string(script), "\n") {
+		if name, ok := strings.CutPrefix(line, ":"); ok {
+			chains = append(chains, strings.Fields(name)[0])
+		}
+	}
+
+	return chains
+}
+
+func buildServiceTable(targets []common.NATTarget, cType chainType) (rules [][]string) {
+	var (
+		affinity     [][]string
+		serviceRules = common.BuildServiceRules(targets)
+	)
+
+	if cType == chainTypeDNAT && len(serviceRules) > 0 && serviceRules[0].Balance == common.BalanceRoundRobin {
+		return buildRoundRobinTable(serviceRules)
+	}
+
+	for _, sr := range serviceRules {
+		switch cType {
+		case chainTypeDNAT:
+			var (
+				match = []string{
+					"-p", sr.Proto,
+					"-d", sr.BindAddr,
+					"--dport", strconv.Itoa(sr.BindPort),
+				}
+				pin    []string
+				target = []string{
+					"-j", "DNAT",
+					"--to-destination", net.JoinHostPort(sr.TargetAddr, strconv.Itoa(sr.TargetPort)),
+				}
+			)
+
+			if sr.Balance == common.BalanceSourceIP {
+				// Clients seen within the affinity timeout are sent to
+				// the same target again before distributing new ones
+				affinity = append(affinity, slices.Concat(match, []string{
+					"-m", "recent",
+					"--name", sr.AffinityName(),
+					"--rsource",
+					"--update",
+					"--seconds", strconv.Itoa(int(sr.AffinityTimeout.Seconds())),
+					"--reap",
+				}, target))
+
+				pin = []string{
+					"-m", "recent",
+					"--name", sr.AffinityName(),
+					"--rsource",
+					"--set",
+				}
+			}
+
+			rules = append(rules, slices.Concat([]string{
+				"-m", "statistic",
+				"--mode", "random",
+				"--probability", strconv.FormatFloat(sr.Probability, 'f', probPrecision, probBitsize),
+			}, match, pin, target))
+
+		case chainTypeSNAT:
+			rules = append(rules, []string{
+				"-p", sr.Proto,
+				"-d", sr.TargetAddr,
+				"--dport", strconv.Itoa(sr.TargetPort),
+
+				"-j", "SNAT",
+				"--to-source", sr.LocalAddr,
+			})
+		}
+	}
+
+	rules = append(affinity, append(rules, []string{"-j", "RETURN"})...)
+
+	return rules
+}
+
+// buildRoundRobinTable renders the DNAT rules distributing the
+// connections in the exact ratio of the target weights: the nth
+// statistic is matched after the destination so only the connections
+// to the service are counted
+func buildRoundRobinTable(serviceRules []common.ServiceRule) (rules [][]string) {
+	for _, slot := range common.RoundRobinSlots(serviceRules) {
+		rules = append(rules, []string{
+			"-p", slot.Proto,
+			"-d", slot.BindAddr,
+			"--dport", strconv.Itoa(slot.BindPort),
+
+			"-m", "statistic",
+			"--mode", "nth",
+			"--every", strconv.Itoa(slot.Every),
+			"--packet", "0",
+
+			"-j", "DNAT",
+			"--to-destination", net.JoinHostPort(slot.TargetAddr, strconv.Itoa(slot.TargetPort)),
+		})
+	}
+
+	return append(rules, []string{"-j", "RETURN"})
+}
+
+// SupportsFamily reports whether the iptables variant for the given
+// address family is available on the system
+func (c *Client) SupportsFamily(family string) bool {
+	for _, fc := range c.families {
+		if fc.family == family {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkFamilySupport ensures there are no targets registered for
+// address families not supported by the system
+func (c *Client) checkFamilySupport() error {
+	for _, s := range c.ServiceNames() {
+		for _, t := range c.ServiceTargets(s) {
+			if !c.SupportsFamily(t.Family) {
+				return fmt.Errorf("service %q has %s targets but %s is not supported", s, t.Family, t.Family)
+			}
+		}
+	}
+
+	return nil
+}
+
+// restore feeds the given script to the restore binary of the family
+// leaving all chains not contained in it untouched
+func (fc familyClient) restore(script []byte, args ...string) error {
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(fc.restorePath, append([]string{"--noflush"}, args...)...) //#nosec:G204 // Path is resolved through LookPath
+	cmd.Stdin = bytes.NewReader(script)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("executing %s: %w (%s)", fc.restorePath, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+func newFamilyClient(family string, proto coreosIptables.Protocol, restoreBin string) (fc familyClient, err error) {
+	fc.family = family
+
+	if fc.IPTables, err = coreosIptables.NewWithProtocol(proto); err != nil {
+		return fc, fmt.Errorf("creating %s iptables client: %w", family, err)
+	}
+	if fc.restorePath, err = exec.LookPath(restoreBin); err != nil {
+		return fc, fmt.Errorf("finding %s binary: %w", restoreBin, err)
+	}
+
+	return fc, nil
+}
@@ -0,0 +1,239 @@
+package iptables
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/common"
+)
+
+func TestRenderRandom(t *testing.T) {
+	expected := strings.Join([]string{
+		"*nat",
+		":LB_WEB_DNAT - [0:0]",
+		":LB_WEB_SNAT - [0:0]",
+		":LB_DNAT - [0:0]",
+		":LB_SNAT - [0:0]",
+		"-A LB_WEB_DNAT -m statistic --mode random --probability 0.500 -p tcp -d 10.0.0.1 --dport 80 -j DNAT --to-destination 10.1.0.1:8080",
+		"-A LB_WEB_DNAT -m statistic --mode random --probability 0.500 -p tcp -d 10.0.0.1 --dport 80 -j DNAT --to-destination 10.1.0.2:8080",
+		"-A LB_WEB_DNAT -m statistic --mode random --probability 1.000 -p tcp -d 10.0.0.1 --dport 80 -j DNAT --to-destination 10.1.0.3:8080",
+		"-A LB_WEB_DNAT -j RETURN",
+		"-A LB_WEB_SNAT -p tcp -d 10.1.0.1 --dport 8080 -j SNAT --to-source 10.1.0.254",
+		"-A LB_WEB_SNAT -p tcp -d 10.1.0.2 --dport 8080 -j SNAT --to-source 10.1.0.254",
+		"-A LB_WEB_SNAT -p tcp -d 10.1.0.3 --dport 8080 -j SNAT --to-source 10.1.0.254",
+		"-A LB_WEB_SNAT -j RETURN",
+		"-A LB_DNAT -j LB_WEB_DNAT",
+		"-A LB_DNAT -j RETURN",
+		"-A LB_SNAT -j LB_WEB_SNAT",
+		"-A LB_SNAT -j RETURN",
+		"COMMIT",
+		"",
+	}, "\n")
+
+	if got := string(Render("LB", common.FamilyIPv4, common.TestRegistry(common.BalanceRandom, 2, 1, 1))); got != expected {
+		t.Errorf("unexpected rules:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestRenderRoundRobin(t *testing.T) {
+	expected := strings.Join([]string{
+		"*nat",
+		":LB_WEB_DNAT - [0:0]",
+		":LB_WEB_SNAT - [0:0]",
+		":LB_DNAT - [0:0]",
+		":LB_SNAT - [0:0]",
+		"-A LB_WEB_DNAT -p tcp -d 10.0.0.1 --dport 80 -m statistic --mode nth --every 6 --packet 0 -j DNAT --to-destination 10.1.0.1:8080",
+		"-A LB_WEB_DNAT -p tcp -d 10.0.0.1 --dport 80 -m statistic --mode nth --every 5 --packet 0 -j DNAT --to-destination 10.1.0.3:8080",
+		"-A LB_WEB_DNAT -p tcp -d 10.0.0.1 --dport 80 -m statistic --mode nth --every 4 --packet 0 -j DNAT --to-destination 10.1.0.1:8080",
+		"-A LB_WEB_DNAT -p tcp -d 10.0.0.1 --dport 80 -m statistic --mode nth --every 3 --packet 0 -j DNAT --to-destination 10.1.0.2:8080",
+		"-A LB_WEB_DNAT -p tcp -d 10.0.0.1 --dport 80 -m statistic --mode nth --every 2 --packet 0 -j DNAT --to-destination 10.1.0.3:8080",
+		"-A LB_WEB_DNAT -p tcp -d 10.0.0.1 --dport 80 -m statistic --mode nth --every 1 --packet 0 -j DNAT --to-destination 10.1.0.1:8080",
+		"-A LB_WEB_DNAT -j RETURN",
+		"-A LB_WEB_SNAT -p tcp -d 10.1.0.1 --dport 8080 -j SNAT --to-source 10.1.0.254",
+		"-A LB_WEB_SNAT -p tcp -d 10.1.0.2 --dport 8080 -j SNAT --to-source 10.1.0.254",
+		"-A LB_WEB_SNAT -p tcp -d 10.1.0.3 --dport 8080 -j SNAT --to-source 10.1.0.254",
+		"-A LB_WEB_SNAT -j RETURN",
+		"-A LB_DNAT -j LB_WEB_DNAT",
+		"-A LB_DNAT -j RETURN",
+		"-A LB_SNAT -j LB_WEB_SNAT",
+		"-A LB_SNAT -j RETURN",
+		"COMMIT",
+		"",
+	}, "\n")
+
+	if got := string(Render("LB", common.FamilyIPv4, common.TestRegistry(common.BalanceRoundRobin, 3, 1, 2))); got != expected {
+		t.Errorf("unexpected rules:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestRenderRemovedService(t *testing.T) {
+	reg := common.TestRegistry(common.BalanceRandom, 1)
+	reg.RemoveService("web")
+
+	expected := strings.Join([]string{
+		"*nat",
+		":LB_DNAT - [0:0]",
+		":LB_SNAT - [0:0]",
+		":LB_WEB_DNAT - [0:0]",
+		":LB_WEB_SNAT - [0:0]",
+		"-A LB_DNAT -j RETURN",
+		"-A LB_SNAT -j RETURN",
+		"-X LB_WEB_DNAT",
+		"-X LB_WEB_SNAT",
+		"COMMIT",
+		"",
+	}, "\n")
+
+	if got := string(Render("LB", common.FamilyIPv4, reg)); got != expected {
+		t.Errorf("unexpected rules:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestBuildServiceTableEmpty(t *testing.T) {
+	for _, cType := range []chainType{chainTypeDNAT, chainTypeSNAT} {
+		rules := buildServiceTable(nil, cType)
+		if len(rules) != 1 || strings.Join(rules[0], " ") != "-j RETURN" {
+			t.Errorf("expected only a RETURN rule for chain type %d, got %v", cType, rules)
+		}
+	}
+}
+
+func TestRenderServiceRules(t *testing.T) {
+	reg := common.TestRegistry(common.BalanceRandom, 1)
+
+	expected := []string{
+		"-A LB_WEB_DNAT -m statistic --mode random --probability 1.000 -p tcp -d 10.0.0.1 --dport 80 -j DNAT --to-destination 10.1.0.1:8080",
+		"-A LB_WEB_DNAT -j RETURN",
+		"-A LB_WEB_SNAT -p tcp -d 10.1.0.1 --dport 8080 -j SNAT --to-source 10.1.0.254",
+		"-A LB_WEB_SNAT -j RETURN",
+	}
+
+	_, rules := render("LB", common.FamilyIPv4, reg)
+	if got := strings.Join(rules["web"], "\n"); got != strings.Join(expected, "\n") {
+		t.Errorf("unexpected service rules:\n%s", got)
+	}
+
+	// Without IPv6 targets the IPv6 chains are not reported
+	if _, rules = render("LB", common.FamilyIPv6, reg); len(rules["web"]) != 0 {
+		t.Errorf("unexpected IPv6 service rules: %v", rules["web"])
+	}
+}
+
+// fakeRestore creates a restore binary for the given family logging
+// its invocations to the returned function and failing when called
+// with the given arguments
+func fakeRestore(t *testing.T, family, failArgs string) (familyClient, func() []restoreCall) {
+	t.Helper()
+
+	var (
+		dir = t.TempDir()
+		bin = filepath.Join(dir, "restore")
+		log = filepath.Join(dir, "log")
+	)
+
+	script := fmt.Sprintf("#!/bin/sh\necho \"== $*\" >>%q\ncat >>%q\n[ \"$*\" = %q ] && exit 1\nexit 0\n", log, log, failArgs)
+	if err := os.WriteFile(bin, []byte(script), 0o700); err != nil { //#nosec:G306 // Needs to be executable
+		t.Fatalf("writing fake restore binary: %s", err)
+	}
+
+	return familyClient{family: family, restorePath: bin}, func() (calls []restoreCall) {
+		data, err := os.ReadFile(log) //#nosec:G304 // Log in temp dir
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("reading log: %s", err)
+		}
+
+		for _, rec := range strings.Split(string(data), "== ")[1:] {
+			args, script, _ := strings.Cut(rec, "\n")
+			calls = append(calls, restoreCall{args, script})
+		}
+		return calls
+	}
+}
+
+type restoreCall struct {
+	args, script string
+}
+
+func TestEnsureManagedChainsDualStack(t *testing.T) {
+	register := func(c *Client, service string) {
+		for _, nt := range []common.NATTarget{
+			{Addr: "10.1.0.1", BindAddr: "10.0.0.1", Family: common.FamilyIPv4, LocalAddr: "10.1.0.254"},
+			{Addr: "2001:db8::11", BindAddr: "2001:db8::1", Family: common.FamilyIPv6, LocalAddr: "2001:db8::fe"},
+		} {
+			nt.BindPort, nt.Port, nt.Proto, nt.Weight = 80, 8080, "tcp", 1
+			c.RegisterServiceTarget(service, nt)
+		}
+	}
+
+	for _, tc := range []struct {
+		name      string
+		failArgs  string
+		v4Calls   []string
+		rollsBack bool
+	}{
+		{
+			name:     "IPv6 test fails",
+			failArgs: "--noflush --test",
+			v4Calls:  []string{"--noflush --test"},
+		},
+		{
+			name:      "IPv6 commit fails",
+			failArgs:  "--noflush",
+			v4Calls:   []string{"--noflush --test", "--noflush", "--noflush"},
+			rollsBack: true,
+		},
+	} {
+		v4, v4Log := fakeRestore(t, common.FamilyIPv4, "")
+		v6, _ := fakeRestore(t, common.FamilyIPv6, tc.failArgs)
+
+		c := &Client{applied: make(map[string][]byte), families: []familyClient{v4, v6}, managedChain: "LB"}
+		register(c, "web")
+
+		previous := Render("LB", common.FamilyIPv4, c)
+		c.applied[common.FamilyIPv4] = previous
+		c.applied[common.FamilyIPv6] = Render("LB", common.FamilyIPv6, c)
+
+		register(c, "api")
+		if err := c.EnsureManagedChains(); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+
+		calls := v4Log()
+		var args []string
+		for _, call := range calls {
+			args = append(args, call.args)
+		}
+		if strings.Join(args, ",") != strings.Join(tc.v4Calls, ",") {
+			t.Errorf("%s: unexpected IPv4 calls %v, expected %v", tc.name, args, tc.v4Calls)
+		}
+
+		if string(c.applied[common.FamilyIPv4]) != string(previous) {
+			t.Errorf("%s: previous IPv4 rules were replaced", tc.name)
+		}
+
+		if !tc.rollsBack {
+			continue
+		}
+
+		// The rollback restores the previous rules and deletes the chains
+		// of the new service no longer referenced
+		rollback := calls[len(calls)-1].script
+		for _, line := range strings.Split(strings.TrimSpace(string(previous)), "\n") {
+			if !strings.Contains(rollback, line+"\n") {
+				t.Errorf("%s: rollback is missing %q", tc.name, line)
+			}
+		}
+		for _, line := range []string{":LB_API_DNAT - [0:0]", "-X LB_API_DNAT", "-X LB_API_SNAT"} {
+			if !strings.Contains(rollback, line+"\n") {
+				t.Errorf("%s: rollback is missing %q:\n%s", tc.name, line, rollback)
+			}
+		}
+		if strings.Contains(rollback, "-A LB_DNAT -j LB_API_DNAT") {
+			t.Errorf("%s: rollback contains jump to the new service:\n%s", tc.name, rollback)
+		}
+	}
+}
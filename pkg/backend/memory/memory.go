@@ -0,0 +1,189 @@
+// Package memory contains a rule backend keeping all state in memory
+// and recording the calls made to it, meant for tests and dry-runs
+// on systems without netfilter access
+package memory
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/common"
+)
+
+type (
+	// Client implements the backend interface without touching the
+	// system and records every call made to it
+	Client struct {
+		common.ServiceRegistry
+
+		lock           sync.Mutex
+		calls          []Call
+		onEnsure       EnsureFunc
+		routingEnabled bool
+		rules          map[string][]string
+		snapshots      []map[string][]common.NATTarget
+	}
+
+	// Call represents a single recorded call to the Client
+	Call struct {
+		Method  string
+		Service string
+		Target  common.NATTarget
+		Changed bool
+	}
+
+	// EnsureFunc is called with the current state of the registry
+	// whenever EnsureManagedChains is called and can be used to render
+	// the rules or to inject errors
+	EnsureFunc func(src common.TargetSource) error
+)
+
+// Method names used in the recorded calls
+const (
+	MethodCleanup          = "Cleanup"
+	MethodEnableRouting    = "EnableMangedRoutingChains"
+	MethodEnsureChains     = "EnsureManagedChains"
+	MethodRegisterTarget   = "RegisterServiceTarget"
+	MethodRemoveService    = "RemoveService"
+	MethodUnregisterTarget = "UnregisterServiceTarget"
+)
+
+// New creates a new in-memory Client calling onEnsure (if non-nil)
+// on every EnsureManagedChains call
+func New(onEnsure EnsureFunc) *Client {
+	return &Client{onEnsure: onEnsure}
+}
+
+// Calls returns a copy of the calls recorded so far
+func (c *Client) Calls() []Call {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return append([]Call(nil), c.calls...)
+}
+
+// Cleanup removes all services and records the routing to be disabled
+func (c *Client) Cleanup() error {
+	for _, s := range c.ServiceNames() {
+		c.ServiceRegistry.RemoveService(s)
+	}
+	c.ForgetRemovedServices(c.RemovedServices())
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.routingEnabled = false
+	c.calls = append(c.calls, Call{Method: MethodCleanup})
+
+	return nil
+}
+
+// EnableMangedRoutingChains records the routing to be enabled
+func (c *Client) EnableMangedRoutingChains() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.routingEnabled = true
+	c.calls = append(c.calls, Call{Method: MethodEnableRouting})
+
+	return nil
+}
+
+// EnsureManagedChains records a snapshot of the registered targets
+// and passes the state to the EnsureFunc. When it succeeds the rules
+// returned by ServiceRules are updated.
+func (c *Client) EnsureManagedChains() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	snapshot := make(map[string][]common.NATTarget)
+	for _, s := range c.ServiceNames() {
+		snapshot[s] = c.ServiceTargets(s)
+	}
+
+	c.snapshots = append(c.snapshots, snapshot)
+	c.calls = append(c.calls, Call{Method: MethodEnsureChains})
+
+	if c.onEnsure != nil {
+		if err := c.onEnsure(c); err != nil {
+			return err
+		}
+	}
+
+	c.rules = make(map[string][]string)
+	for s, targets := range snapshot {
+		for _, family := range common.Families {
+			for _, t := range common.ActiveTier(common.FilterFamily(targets, family)) {
+				c.rules[s] = append(c.rules[s], fmt.Sprintf("%s %s -> %s", t.Proto, net.JoinHostPort(t.BindAddr, strconv.Itoa(t.BindPort)), t))
+			}
+		}
+	}
+
+	c.ForgetRemovedServices(c.RemovedServices())
+	return nil
+}
+
+// RegisterServiceTarget adds a new routing target to the given service
+func (c *Client) RegisterServiceTarget(service string, t common.NATTarget) bool {
+	changed := c.ServiceRegistry.RegisterServiceTarget(service, t)
+	c.record(MethodRegisterTarget, service, t, changed)
+	return changed
+}
+
+// RemoveService removes the service and all its targets
+func (c *Client) RemoveService(service string) bool {
+	changed := c.ServiceRegistry.RemoveService(service)
+	c.record(MethodRemoveService, service, common.NATTarget{}, changed)
+	return changed
+}
+
+// RoutingEnabled reports whether EnableMangedRoutingChains was called
+func (c *Client) RoutingEnabled() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.routingEnabled
+}
+
+// ServiceRules returns one entry per target of the active priority
+// tier of the service as of the last successful EnsureManagedChains
+// call as the in-memory backend does not render any rules
+func (c *Client) ServiceRules(service string) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return append([]string(nil), c.rules[service]...)
+}
+
+// Snapshots returns the registered targets for each service as they
+// were at the time of each EnsureManagedChains call
+func (c *Client) Snapshots() []map[string][]common.NATTarget {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return append([]map[string][]common.NATTarget(nil), c.snapshots...)
+}
+
+// SupportsFamily reports all address families to be supported
+func (*Client) SupportsFamily(string) bool { return true }
+
+// UnregisterServiceTarget removes a routing target from the given service
+func (c *Client) UnregisterServiceTarget(service string, t common.NATTarget) bool {
+	changed := c.ServiceRegistry.UnregisterServiceTarget(service, t)
+	c.record(MethodUnregisterTarget, service, t, changed)
+	return changed
+}
+
+func (c *Client) record(method, service string, t common.NATTarget, changed bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.calls = append(c.calls, Call{
+		Method:  method,
+		Service: service,
+		Target:  t,
+		Changed: changed,
+	})
+}
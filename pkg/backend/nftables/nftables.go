@@ -0,0 +1,331 @@
+// Package nftables contains the logic to interact with the nftables
+// system interface through the nft command line utility
+package nftables
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/common"
+)
+
+const (
+	family        = "inet"
+	probPrecision = 1000
+)
+
+// nftFamilies maps the address families to the keyword used to match
+// and translate addresses of that family within the inet table
+var nftFamilies = map[string]string{
+	common.FamilyIPv4: "ip",
+	common.FamilyIPv6: "ip6",
+}
+
+// nftAddrTypes maps the address families to the type of the sets
+// holding addresses of that family
+var nftAddrTypes = map[string]string{
+	common.FamilyIPv4: "ipv4_addr",
+	common.FamilyIPv6: "ipv6_addr",
+}
+
+type (
+	// Client contains the required functions to create the loadbalancing
+	Client struct {
+		common.ServiceRegistry
+
+		applyLock    sync.Mutex
+		managedChain string
+		nftPath      string
+
+		rulesLock sync.RWMutex
+		rules     map[string][]string
+		sets      map[string]bool
+	}
+
+	// affinitySet describes a set of client addresses pinned to a
+	// target when balancing by source IP
+	affinitySet struct {
+		name     string
+		addrType string
+	}
+
+	chainType uint
+)
+
+const (
+	chainTypeDNAT chainType = iota
+	chainTypeSNAT
+)
+
+// New creates a new NFTables client
+func New(managedChain string) (c *Client, err error) {
+	c = &Client{
+		managedChain: managedChain,
+	}
+	if c.nftPath, err = exec.LookPath("nft"); err != nil {
+		return nil, fmt.Errorf("finding nft binary: %w", err)
+	}
+
+	return c, nil
+}
+
+// EnsureManagedChains creates the managed chain referring to the
+// service chains while only leading the specified address / port
+// to that service chain. All chains are replaced within one nft
+// transaction.
+func (c *Client) EnsureManagedChains() (err error) {
+	c.applyLock.Lock()
+	defer c.applyLock.Unlock()
+
+	removed := c.RemovedServices()
+
+	script, rules, sets := render(c.managedChain, c, c.sets)
+	if err = c.apply(script); err != nil {
+		return fmt.Errorf("applying managed chains: %w", err)
+	}
+
+	c.rulesLock.Lock()
+	c.rules = rules
+	c.rulesLock.Unlock()
+
+	c.sets = sets
+
+	c.ForgetRemovedServices(removed)
+	return nil
+}
+
+// Cleanup deletes the table named after the managed chain prefix
+// including all managed chains and the hooked base chains
+func (c *Client) Cleanup() (err error) {
+	c.applyLock.Lock()
+	defer c.applyLock.Unlock()
+
+	// Adding the table before deleting it prevents the transaction to
+	// fail in case the table does not exist
+	if err = c.apply([]byte(fmt.Sprintf(
+		"add table %[1]s %[2]s\ndelete table %[1]s %[2]s\n",
+		family, c.managedChain,
+	))); err != nil {
+		return fmt.Errorf("deleting managed table: %w", err)
+	}
+
+	return nil
+}
+
+// EnableMangedRoutingChains creates the nat base chains hooked into
+// prerouting and postrouting containing a jump to the managed chains
+func (c *Client) EnableMangedRoutingChains() (err error) {
+	s := new(strings.Builder)
+
+	fmt.Fprintf(s, "add table %s %s\n", family, c.managedChain)
+	for _, hook := range []struct{ chain, hook, target string }{
+		{"PREROUTING", "prerouting priority -100", common.ChainName(c.managedChain, "DNAT")},
+		{"POSTROUTING", "postrouting priority 100", common.ChainName(c.managedChain, "SNAT")},
+	} {
+		fmt.Fprintf(s, "add chain %s %s %s { type nat hook %s; policy accept; }\n", family, c.managedChain, hook.chain, hook.hook)
+		fmt.Fprintf(s, "flush chain %s %s %s\n", family, c.managedChain, hook.chain)
+		fmt.Fprintf(s, "add rule %s %s %s jump %s\n", family, c.managedChain, hook.chain, hook.target)
+	}
+
+	if err = c.apply([]byte(s.String())); err != nil {
+		return fmt.Errorf("ensuring jumps to managed chains: %w", err)
+	}
+
+	return nil
+}
+
+// Render renders all managed chains for the services in the given
+// source into a nft script replacing the chains within the table
+// named after the managed chain prefix. Chains of removed services
+// are deleted.
+func Render(managedChain string, src common.TargetSource) []byte {
+	script, _, _ := render(managedChain, src, nil)
+	return script
+}
+
+// ServiceRules returns the rules of the chains of the given service
+// as applied by the last successful EnsureManagedChains call
+func (c *Client) ServiceRules(service string) []string {
+	c.rulesLock.RLock()
+	defer c.rulesLock.RUnlock()
+
+	return append([]string(nil), c.rules[service]...)
+}
+
+// render renders the nft script and additionally returns the rules
+// of the chains of each service and the names of the affinity sets.
+// When the previously applied sets are given, the sets not contained
+// are flushed: the set of a target returning into rotation must not
+// pin clients which were pinned to another target in the meantime.
+// Applied sets no longer rendered are deleted after the chains
+// referring to them were replaced.
+func render(managedChain string, src common.TargetSource, applied map[string]bool) (script []byte, serviceRules map[string][]string, sets map[string]bool) {
+	var (
+		dnat []string
+		snat []string
+		s    = new(strings.Builder)
+	)
+
+	serviceRules = make(map[string][]string)
+	sets = make(map[string]bool)
+
+	fmt.Fprintf(s, "add table %s %s\n", family, managedChain)
+
+	for _, svc := range src.ServiceNames() {
+		for _, ct := range []struct {
+			chain string
+			cType chainType
+		}{
+			{common.ChainName(managedChain, svc, "DNAT"), chainTypeDNAT},
+			{common.ChainName(managedChain, svc, "SNAT"), chainTypeSNAT},
+		} {
+			rules, affinitySets := buildServiceTable(src.ServiceTargets(svc), ct.cType)
+			for _, set := range affinitySets {
+				fmt.Fprintf(s, "add set %s %s %s { type %s; flags dynamic,timeout; }\n", family, managedChain, set.name, set.addrType)
+				if applied != nil && !applied[set.name] {
+					fmt.Fprintf(s, "flush set %s %s %s\n", family, managedChain, set.name)
+				}
+				sets[set.name] = true
+			}
+			writeChainWithRules(s, managedChain, ct.chain, rules)
+
+			for _, rule := range rules {
+				serviceRules[svc] = append(serviceRules[svc], fmt.Sprintf("add rule %s %s %s %s", family, managedChain, ct.chain, rule))
+			}
+		}
+
+		dnat = append(dnat, "jump "+common.ChainName(managedChain, svc, "DNAT"))
+		snat = append(snat, "jump "+common.ChainName(managedChain, svc, "SNAT"))
+	}
+
+	writeChainWithRules(s, managedChain, common.ChainName(managedChain, "DNAT"), append(dnat, "return"))
+	writeChainWithRules(s, managedChain, common.ChainName(managedChain, "SNAT"), append(snat, "return"))
+
+	for _, svc := range src.RemovedServices() {
+		for _, chain := range []string{common.ChainName(managedChain, svc, "DNAT"), common.ChainName(managedChain, svc, "SNAT")} {
+			// Adding the chain before deleting it prevents the whole
+			// transaction to fail in case the chain does not exist
+			fmt.Fprintf(s, "add chain %s %s %s\n", family, managedChain, chain)
+			fmt.Fprintf(s, "delete chain %s %s %s\n", family, managedChain, chain)
+		}
+	}
+
+	var stale []string
+	for name := range applied {
+		if !sets[name] {
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(stale)
+
+	for _, name := range stale {
+		fmt.Fprintf(s, "delete set %s %s %s\n", family, managedChain, name)
+	}
+
+	return []byte(s.String()), serviceRules, sets
+}
+
+// SupportsFamily reports whether the given address family can be
+// routed which is true for all families as the inet table handles
+// IPv4 and IPv6
+func (*Client) SupportsFamily(string) bool { return true }
+
+func (c *Client) apply(script []byte) error {
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(c.nftPath, "-f", "-") //#nosec:G204 // Path is resolved through LookPath
+	cmd.Stdin = bytes.NewReader(script)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("executing nft: %w (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// buildServiceTable renders the rules for the targets of all address
+// families into one chain: as the rules match the destination address
+// first, the probabilities are calculated per address family. When
+// balancing by source IP the sets of the client addresses pinned to
+// the targets are returned to be declared before the chain.
+func buildServiceTable(targets []common.NATTarget, cType chainType) (rules []string, sets []affinitySet) {
+	var affinity []string
+
+	for _, fam := range common.Families {
+		nftFam := nftFamilies[fam]
+
+		serviceRules := common.BuildServiceRules(common.FilterFamily(targets, fam))
+
+		if cType == chainTypeDNAT && len(serviceRules) > 0 && serviceRules[0].Balance == common.BalanceRoundRobin {
+			// Every rule keeps its own counter which is only increased
+			// for the connections to the service
+			for _, slot := range common.RoundRobinSlots(serviceRules) {
+				rules = append(rules, fmt.Sprintf(
+					"%s daddr %s %s dport %d numgen inc mod %d == 0 dnat %s to %s",
+					nftFam, slot.BindAddr, slot.Proto, slot.BindPort, slot.Every,
+					nftFam, net.JoinHostPort(slot.TargetAddr, strconv.Itoa(slot.TargetPort)),
+				))
+			}
+			continue
+		}
+
+		for _, sr := range serviceRules {
+			switch cType {
+			case chainTypeDNAT:
+				var (
+					match  = fmt.Sprintf("%s daddr %s %s dport %d", nftFam, sr.BindAddr, sr.Proto, sr.BindPort)
+					pin    string
+					target = fmt.Sprintf("dnat %s to %s", nftFam, net.JoinHostPort(sr.TargetAddr, strconv.Itoa(sr.TargetPort)))
+				)
+
+				if sr.Balance == common.BalanceSourceIP {
+					// Clients seen within the affinity timeout are sent
+					// to the same target again before distributing new
+					// ones
+					sets = append(sets, affinitySet{name: sr.AffinityName(), addrType: nftAddrTypes[fam]})
+					pin = fmt.Sprintf(
+						" update @%s { %s saddr timeout %ds }",
+						sr.AffinityName(), nftFam, int(sr.AffinityTimeout.Seconds()),
+					)
+					affinity = append(affinity, fmt.Sprintf(
+						"%s %s saddr @%s%s %s",
+						match, nftFam, sr.AffinityName(), pin, target,
+					))
+				}
+
+				rules = append(rules, fmt.Sprintf(
+					"%s numgen random mod %d < %d%s %s",
+					match, probPrecision, int(math.Round(sr.Probability*probPrecision)), pin, target,
+				))
+
+			case chainTypeSNAT:
+				rules = append(rules, fmt.Sprintf(
+					"%s daddr %s %s dport %d snat %s to %s",
+					nftFam, sr.TargetAddr, sr.Proto, sr.TargetPort,
+					nftFam, sr.LocalAddr,
+				))
+			}
+		}
+	}
+
+	rules = append(affinity, append(rules, "return")...)
+
+	return rules, sets
+}
+
+func writeChainWithRules(s *strings.Builder, table, chain string, rules []string) {
+	fmt.Fprintf(s, "add chain %s %s %s\n", family, table, chain)
+	fmt.Fprintf(s, "flush chain %s %s %s\n", family, table, chain)
+
+	for _, rule := range rules {
+		fmt.Fprintf(s, "add rule %s %s %s %s\n", family, table, chain, rule)
+	}
+}
@@ -0,0 +1,110 @@
+package nftables
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/common"
+)
+
+func TestRenderFlushesReturningAffinitySets(t *testing.T) {
+	const (
+		set1 = "AFF_10_0_0_1_80_10_1_0_1_8080"
+		set2 = "AFF_10_0_0_1_80_10_1_0_2_8080"
+	)
+
+	flushed := func(script []byte) (sets []string) {
+		for _, line := range strings.Split(string(script), "\n") {
+			if set, ok := strings.CutPrefix(line, "flush set inet LB "); ok {
+				sets = append(sets, set)
+			}
+		}
+		return sets
+	}
+
+	reg := common.TestRegistry(common.BalanceSourceIP, 1, 1)
+
+	// Pins must survive a restart so the first apply keeps the sets
+	script, _, sets := render("LB", reg, nil)
+	if f := flushed(script); len(f) != 0 {
+		t.Errorf("expected no sets to be flushed on first apply, got %v", f)
+	}
+	if len(sets) != 2 || !sets[set1] || !sets[set2] {
+		t.Errorf("unexpected sets: %v", sets)
+	}
+
+	// The second target returns into rotation: its set may contain
+	// clients pinned before they were pinned to the first target
+	script, _, _ = render("LB", reg, map[string]bool{set1: true})
+	if f := flushed(script); len(f) != 1 || f[0] != set2 {
+		t.Errorf("expected only %s to be flushed, got %v", set2, f)
+	}
+
+	script, _, _ = render("LB", reg, sets)
+	if f := flushed(script); len(f) != 0 {
+		t.Errorf("expected no sets to be flushed on unchanged targets, got %v", f)
+	}
+}
+
+func TestRenderDeletesStaleAffinitySets(t *testing.T) {
+	const (
+		set1 = "AFF_10_0_0_1_80_10_1_0_1_8080"
+		set2 = "AFF_10_0_0_1_80_10_1_0_2_8080"
+		set3 = "AFF_10_0_0_2_80_10_1_0_1_8080"
+	)
+
+	// The second target left rotation and the service bound to the
+	// second address was removed: both their sets must be deleted
+	// after the chains referring to them were replaced
+	script, _, sets := render("LB", common.TestRegistry(common.BalanceSourceIP, 1), map[string]bool{set1: true, set2: true, set3: true})
+
+	lines := strings.Split(strings.TrimSuffix(string(script), "\n"), "\n")
+	expected := []string{"delete set inet LB " + set2, "delete set inet LB " + set3}
+
+	if tail := lines[len(lines)-len(expected):]; !reflect.DeepEqual(tail, expected) {
+		t.Errorf("expected script to end with %v, got %v", expected, tail)
+	}
+
+	if strings.Count(string(script), "delete set") != len(expected) {
+		t.Errorf("expected only stale sets to be deleted:\n%s", script)
+	}
+
+	if len(sets) != 1 || !sets[set1] {
+		t.Errorf("unexpected sets: %v", sets)
+	}
+}
+
+func TestRenderRoundRobin(t *testing.T) {
+	expected := strings.Join([]string{
+		"add table inet LB",
+		"add chain inet LB LB_WEB_DNAT",
+		"flush chain inet LB LB_WEB_DNAT",
+		"add rule inet LB LB_WEB_DNAT ip daddr 10.0.0.1 tcp dport 80 numgen inc mod 6 == 0 dnat ip to 10.1.0.1:8080",
+		"add rule inet LB LB_WEB_DNAT ip daddr 10.0.0.1 tcp dport 80 numgen inc mod 5 == 0 dnat ip to 10.1.0.3:8080",
+		"add rule inet LB LB_WEB_DNAT ip daddr 10.0.0.1 tcp dport 80 numgen inc mod 4 == 0 dnat ip to 10.1.0.1:8080",
+		"add rule inet LB LB_WEB_DNAT ip daddr 10.0.0.1 tcp dport 80 numgen inc mod 3 == 0 dnat ip to 10.1.0.2:8080",
+		"add rule inet LB LB_WEB_DNAT ip daddr 10.0.0.1 tcp dport 80 numgen inc mod 2 == 0 dnat ip to 10.1.0.3:8080",
+		"add rule inet LB LB_WEB_DNAT ip daddr 10.0.0.1 tcp dport 80 numgen inc mod 1 == 0 dnat ip to 10.1.0.1:8080",
+		"add rule inet LB LB_WEB_DNAT return",
+		"add chain inet LB LB_WEB_SNAT",
+		"flush chain inet LB LB_WEB_SNAT",
+		"add rule inet LB LB_WEB_SNAT ip daddr 10.1.0.1 tcp dport 8080 snat ip to 10.1.0.254",
+		"add rule inet LB LB_WEB_SNAT ip daddr 10.1.0.2 tcp dport 8080 snat ip to 10.1.0.254",
+		"add rule inet LB LB_WEB_SNAT ip daddr 10.1.0.3 tcp dport 8080 snat ip to 10.1.0.254",
+		"add rule inet LB LB_WEB_SNAT return",
+		"add chain inet LB LB_DNAT",
+		"flush chain inet LB LB_DNAT",
+		"add rule inet LB LB_DNAT jump LB_WEB_DNAT",
+		"add rule inet LB LB_DNAT return",
+		"add chain inet LB LB_SNAT",
+		"flush chain inet LB LB_SNAT",
+		"add rule inet LB LB_SNAT jump LB_WEB_SNAT",
+		"add rule inet LB LB_SNAT return",
+		"",
+	}, "\n")
+
+	if got := string(Render("LB", common.TestRegistry(common.BalanceRoundRobin, 3, 1, 2))); got != expected {
+		t.Errorf("unexpected rules:\n%s\nexpected:\n%s", got, expected)
+	}
+}
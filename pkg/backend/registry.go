@@ -0,0 +1,73 @@
+// Package backend contains the interface rule backends have to
+// implement and a registry to get them by name
+package backend
+
+import (
+	"bytes"
+	"fmt"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/common"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/iptables"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/nftables"
+)
+
+type (
+	// Backend defines the interface a rule backend must support
+	Backend interface {
+		common.TargetSource
+
+		Cleanup() error
+		EnableMangedRoutingChains() error
+		EnsureManagedChains() error
+		RegisterServiceTarget(service string, t common.NATTarget) bool
+		RemoveService(service string) bool
+		RestoreLastKnownGood() bool
+		ServiceRules(service string) []string
+		SupportsFamily(family string) bool
+		UnregisterServiceTarget(service string, t common.NATTarget) bool
+	}
+)
+
+// ByName creates the Backend for the given name managing chains
+// with the given prefix
+func ByName(name, managedChain string) (Backend, error) {
+	switch name {
+	case "iptables":
+		c, err := iptables.New(managedChain)
+		if err != nil {
+			return nil, fmt.Errorf("creating iptables client: %w", err)
+		}
+		return c, nil
+
+	case "nftables":
+		c, err := nftables.New(managedChain)
+		if err != nil {
+			return nil, fmt.Errorf("creating nftables client: %w", err)
+		}
+		return c, nil
+
+	default:
+		return nil, fmt.Errorf("backend %q not found", name)
+	}
+}
+
+// Render renders the rules for the given source in the format the
+// backend with the given name would apply them. For iptables the
+// rulesets of all address families are concatenated.
+func Render(name, managedChain string, src common.TargetSource) ([]byte, error) {
+	switch name {
+	case "iptables":
+		buf := new(bytes.Buffer)
+		for _, family := range common.Families {
+			fmt.Fprintf(buf, "# %s\n", family)
+			buf.Write(iptables.Render(managedChain, family, src))
+		}
+		return buf.Bytes(), nil
+
+	case "nftables":
+		return nftables.Render(managedChain, src), nil
+
+	default:
+		return nil, fmt.Errorf("backend %q not found", name)
+	}
+}
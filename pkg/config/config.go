@@ -5,9 +5,12 @@ import (
 	"bytes"
 	_ "embed"
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 	"time"
 
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/common"
 	"github.com/Luzifer/go_helpers/v2/fieldcollection"
 	"gopkg.in/yaml.v3"
 )
@@ -15,38 +18,121 @@ import (
 type (
 	// File wraps the whole config file content
 	File struct {
+		Backend      string    `yaml:"backend"`
 		ManagedChain string    `yaml:"managedChain"`
 		Services     []Service `yaml:"services"`
 	}
 
 	// Service represents a single service to be exposed
 	Service struct {
-		Name        string             `yaml:"name"`
-		HealthCheck ServiceHealthCheck `yaml:"healthCheck"`
-		BindAddr    string             `yaml:"bindAddr"`
-		BindPort    int                `yaml:"bindPort"`
-		Proto       string             `yaml:"proto"`
-		Targets     []Target           `yaml:"targets"`
+		Name               string                    `yaml:"name"`
+		HealthCheck        ServiceHealthCheck        `yaml:"healthCheck"`
+		PassiveHealthCheck ServicePassiveHealthCheck `yaml:"passiveHealthCheck"`
+		OutlierDetection   ServiceOutlierDetection   `yaml:"outlierDetection"`
+		Panic              ServicePanic              `yaml:"panic"`
+		BindAddr           string                    `yaml:"bindAddr"`
+		BindAddrs          []string                  `yaml:"bindAddrs"`
+		BindPort           int                       `yaml:"bindPort"`
+		Balance            string                    `yaml:"balance"`
+		AffinityTimeout    time.Duration             `yaml:"affinityTimeout"`
+		Conntrack          ServiceConntrack          `yaml:"conntrack"`
+		Proto              string                    `yaml:"proto"`
+		Targets            []Target                  `yaml:"targets"`
+	}
+
+	// ServiceConntrack defines what happens to the established flows
+	// of a target removed from the rotation
+	ServiceConntrack struct {
+		Policy      string        `yaml:"policy"`
+		GracePeriod time.Duration `yaml:"gracePeriod"`
+	}
+
+	// HealthCheck defines one of multiple checks combined to deem
+	// the targets alive
+	HealthCheck struct {
+		Name     string                           `yaml:"name"`
+		Type     string                           `yaml:"type"`
+		Port     int                              `yaml:"port"`
+		Settings *fieldcollection.FieldCollection `yaml:"settings"`
 	}
 
 	// ServiceHealthCheck defines type and settings for the health-
-	// check to apply to the targets to deem them alive
+	// check to apply to the targets to deem them alive. Instead of a
+	// single type multiple checks can be given whose results are
+	// combined according to the mode.
 	ServiceHealthCheck struct {
 		Type     string                           `yaml:"type"`
 		Interval time.Duration                    `yaml:"interval"`
+		Rise     int                              `yaml:"rise"`
+		Fall     int                              `yaml:"fall"`
 		Settings *fieldcollection.FieldCollection `yaml:"settings"`
+
+		Checks []HealthCheck `yaml:"checks"`
+		Mode   string        `yaml:"mode"`
+		Quorum int           `yaml:"quorum"`
+	}
+
+	// ServiceOutlierDetection defines how long to keep targets out of
+	// rotation which were repeatedly taken out of rotation
+	ServiceOutlierDetection struct {
+		Enabled            bool          `yaml:"enabled"`
+		Ejections          int           `yaml:"ejections"`
+		Window             time.Duration `yaml:"window"`
+		BaseEjectionTime   time.Duration `yaml:"baseEjectionTime"`
+		MaxEjectionTime    time.Duration `yaml:"maxEjectionTime"`
+		MaxEjectionPercent int           `yaml:"maxEjectionPercent"`
+	}
+
+	// ServicePanic defines what to route to when too few targets of
+	// the service are healthy
+	ServicePanic struct {
+		Threshold int    `yaml:"threshold"`
+		Mode      string `yaml:"mode"`
+	}
+
+	// ServicePassiveHealthCheck defines when to take a target out of
+	// rotation based on the outcome of the flows DNATed to it as seen
+	// in the kernel connection tracking
+	ServicePassiveHealthCheck struct {
+		Enabled      bool          `yaml:"enabled"`
+		Window       time.Duration `yaml:"window"`
+		MinFlows     int           `yaml:"minFlows"`
+		MaxErrorRate float64       `yaml:"maxErrorRate"`
 	}
 
 	// Target represents a load-balancing target to route the traffic
 	// to in case it is deemed alive
 	Target struct {
-		Addr      string `yaml:"addr"`
-		LocalAddr string `yaml:"localAddr"`
-		Port      int    `yaml:"port"`
-		Weight    int    `yaml:"weight"`
+		Addr       string   `yaml:"addr"`
+		LocalAddr  string   `yaml:"localAddr"`
+		LocalAddrs []string `yaml:"localAddrs"`
+		Port       int      `yaml:"port"`
+		Weight     int      `yaml:"weight"`
+		Priority   int      `yaml:"priority"`
+		Backup     bool     `yaml:"backup"`
 	}
 )
 
+// Modes to combine the results of multiple health-checks
+const (
+	CheckModeAll    = "all"
+	CheckModeAny    = "any"
+	CheckModeQuorum = "quorum"
+)
+
+// Modes available for services in panic
+const (
+	PanicModeAll    = "all"
+	PanicModeFreeze = "freeze"
+)
+
+// Policies available for the established flows of removed targets
+const (
+	ConntrackPolicyExpire = "expire"
+	ConntrackPolicyFlush  = "flush"
+	ConntrackPolicyKeep   = "keep"
+)
+
 //go:embed default.yaml
 var defaultConfig []byte
 
@@ -71,9 +157,261 @@ func Load(fn string) (cf File, err error) {
 		return cf, fmt.Errorf("unmarshalling config file: %w", err)
 	}
 
+	if err = cf.Validate(); err != nil {
+		return cf, fmt.Errorf("validating config file: %w", err)
+	}
+
 	return cf, nil
 }
 
+// Validate checks the services for address combinations which cannot
+// be expressed in rules
+func (f File) Validate() error {
+	for _, s := range f.Services {
+		if err := s.Validate(); err != nil {
+			return fmt.Errorf("service %q: %w", s.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the policy is known and the expire policy has a
+// grace period to expire the flows after
+func (s ServiceConntrack) Validate() error {
+	switch s.Policy {
+	case "", ConntrackPolicyFlush, ConntrackPolicyKeep:
+		return nil
+
+	case ConntrackPolicyExpire:
+		if s.GracePeriod <= 0 {
+			return fmt.Errorf("policy %q requires a gracePeriod", s.Policy)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown policy %q", s.Policy)
+	}
+}
+
+// CheckDefinitions returns the checks to execute for each target:
+// either the given list of checks or the single check defined by
+// type and settings
+func (s ServiceHealthCheck) CheckDefinitions() []HealthCheck {
+	if len(s.Checks) > 0 {
+		return s.Checks
+	}
+
+	return []HealthCheck{{Type: s.Type, Settings: s.Settings}}
+}
+
+// CheckMode returns the mode to combine the check results with
+// (defaults to all)
+func (s ServiceHealthCheck) CheckMode() string {
+	if s.Mode == "" {
+		return CheckModeAll
+	}
+	return s.Mode
+}
+
+// FallThreshold returns the number of consecutive failed checks
+// required to take a target out of rotation (at least 1)
+func (s ServiceHealthCheck) FallThreshold() int {
+	if s.Fall < 1 {
+		return 1
+	}
+	return s.Fall
+}
+
+// QuorumThreshold returns the number of checks required to succeed
+// in quorum mode (defaults to the majority of the checks)
+func (s ServiceHealthCheck) QuorumThreshold() int {
+	if s.Quorum < 1 {
+		return len(s.CheckDefinitions())/2 + 1 //nolint:mnd // Majority
+	}
+	return s.Quorum
+}
+
+// RiseThreshold returns the number of consecutive successful checks
+// required to put a target back into rotation (at least 1)
+func (s ServiceHealthCheck) RiseThreshold() int {
+	if s.Rise < 1 {
+		return 1
+	}
+	return s.Rise
+}
+
+// EjectionThreshold returns the number of times a target must have
+// been taken out of rotation within the window to be ejected as an
+// outlier (defaults to 3)
+func (s ServiceOutlierDetection) EjectionThreshold() int {
+	if s.Ejections < 1 {
+		return 3 //nolint:mnd // Default threshold
+	}
+	return s.Ejections
+}
+
+// EjectionTime returns the duration to keep a target ejected for
+// being an outlier the given number of times in a row: the base
+// ejection time (defaults to 30s) doubles with every further ejection
+// up to the max ejection time (defaults to 5m)
+func (s ServiceOutlierDetection) EjectionTime(n int) time.Duration {
+	var (
+		base = s.BaseEjectionTime
+		maxT = s.MaxEjectionTime
+	)
+
+	if base <= 0 {
+		base = 30 * time.Second //nolint:mnd // Default base ejection time
+	}
+	if maxT <= 0 {
+		maxT = 5 * time.Minute //nolint:mnd // Default max ejection time
+	}
+
+	d := base
+	for i := 1; i < n && d < maxT; i++ {
+		d *= 2
+	}
+
+	return min(d, maxT)
+}
+
+// MaxEjected returns how many of the given number of targets may be
+// ejected as outliers at the same time (at least one, defaults to
+// 50%)
+func (s ServiceOutlierDetection) MaxEjected(targets int) int {
+	pct := s.MaxEjectionPercent
+	if pct < 1 {
+		pct = 50 //nolint:mnd // Default percentage
+	}
+
+	return max(1, targets*pct/100) //nolint:mnd // Percentage
+}
+
+// Validate checks the settings are within their bounds
+func (s ServiceOutlierDetection) Validate() error {
+	if s.MaxEjectionPercent < 0 || s.MaxEjectionPercent > 100 {
+		return fmt.Errorf("maxEjectionPercent %d is not within 0-100", s.MaxEjectionPercent)
+	}
+
+	if s.BaseEjectionTime > 0 && s.MaxEjectionTime > 0 && s.BaseEjectionTime > s.MaxEjectionTime {
+		return fmt.Errorf("baseEjectionTime exceeds maxEjectionTime")
+	}
+
+	return nil
+}
+
+// WindowDuration returns the time-frame to count the times a target
+// was taken out of rotation in (defaults to 5m)
+func (s ServiceOutlierDetection) WindowDuration() time.Duration {
+	if s.Window <= 0 {
+		return 5 * time.Minute //nolint:mnd // Default window
+	}
+	return s.Window
+}
+
+// PanicMode returns what to route to in panic (defaults to all)
+func (s ServicePanic) PanicMode() string {
+	if s.Mode == "" {
+		return PanicModeAll
+	}
+	return s.Mode
+}
+
+// Validate checks the threshold is a percentage and the mode is known
+func (s ServicePanic) Validate() error {
+	if s.Threshold < 0 || s.Threshold > 100 {
+		return fmt.Errorf("threshold %d is not within 0-100", s.Threshold)
+	}
+
+	switch s.PanicMode() {
+	case PanicModeAll, PanicModeFreeze:
+		return nil
+	default:
+		return fmt.Errorf("unknown mode %q", s.Mode)
+	}
+}
+
+// ErrorRateThreshold returns the share of failed flows (0-1) above
+// which the target is taken out of rotation (defaults to 0.5)
+func (s ServicePassiveHealthCheck) ErrorRateThreshold() float64 {
+	if s.MaxErrorRate <= 0 {
+		return 0.5 //nolint:mnd // Default threshold
+	}
+	return s.MaxErrorRate
+}
+
+// MinFlowCount returns the number of flows required within the
+// window before the error rate is evaluated (defaults to 10)
+func (s ServicePassiveHealthCheck) MinFlowCount() int {
+	if s.MinFlows < 1 {
+		return 10 //nolint:mnd // Default minimum
+	}
+	return s.MinFlows
+}
+
+// Validate checks the thresholds are within their bounds
+func (s ServicePassiveHealthCheck) Validate() error {
+	if s.MaxErrorRate < 0 || s.MaxErrorRate > 1 {
+		return fmt.Errorf("maxErrorRate %v is not within 0-1", s.MaxErrorRate)
+	}
+
+	if s.Window < 0 {
+		return fmt.Errorf("window must not be negative")
+	}
+
+	return nil
+}
+
+// WindowDuration returns the time-frame to evaluate the flows in
+// (defaults to 30s)
+func (s ServicePassiveHealthCheck) WindowDuration() time.Duration {
+	if s.Window <= 0 {
+		return 30 * time.Second //nolint:mnd // Default window
+	}
+	return s.Window
+}
+
+// AffinityTimeoutDuration returns for how long a client stays pinned
+// to a target after its last connection when balancing by source IP
+// (defaults to 1h)
+func (s Service) AffinityTimeoutDuration() time.Duration {
+	if s.AffinityTimeout <= 0 {
+		return time.Hour
+	}
+	return s.AffinityTimeout
+}
+
+// BalanceMode returns the mode to balance the connections between the
+// targets (defaults to random)
+func (s Service) BalanceMode() string {
+	if s.Balance == "" {
+		return common.BalanceRandom
+	}
+	return s.Balance
+}
+
+// BindAddressFamily returns the address family the given bind address
+// is routed in: hostnames are bound in IPv4 and resolved when the
+// rules are rendered
+func BindAddressFamily(addr string) string {
+	if family := common.AddrFamily(addr); family != "" {
+		return family
+	}
+
+	return common.FamilyIPv4
+}
+
+// BindAddresses returns the bindAddr and the additional bindAddrs of
+// the service
+func (s Service) BindAddresses() (addrs []string) {
+	if s.BindAddr != "" {
+		addrs = append(addrs, s.BindAddr)
+	}
+
+	return append(addrs, s.BindAddrs...)
+}
+
 // Protocol evaluates the Proto and returns tcp if empty
 func (s Service) Protocol() string {
 	if s.Proto == "" {
@@ -82,4 +420,151 @@ func (s Service) Protocol() string {
 	return s.Proto
 }
 
-func (t Target) String() string { return fmt.Sprintf("%s:%d", t.Addr, t.Port) }
+// Validate checks the service binds to at most one IP per address
+// family and all targets can be paired with a bind address of the
+// same address family
+func (s Service) Validate() error {
+	bindFamilies := make(map[string]bool)
+
+	for _, addr := range s.BindAddresses() {
+		family := BindAddressFamily(addr)
+		if bindFamilies[family] {
+			return fmt.Errorf("multiple bind addresses of family %s", family)
+		}
+		bindFamilies[family] = true
+	}
+
+	if len(bindFamilies) == 0 {
+		return fmt.Errorf("no bind address given")
+	}
+
+	switch s.BalanceMode() {
+	case common.BalanceRandom, common.BalanceRoundRobin, common.BalanceSourceIP:
+	default:
+		return fmt.Errorf("unknown balance mode %q", s.Balance)
+	}
+
+	if err := s.HealthCheck.Validate(); err != nil {
+		return fmt.Errorf("health-check: %w", err)
+	}
+
+	if err := s.PassiveHealthCheck.Validate(); err != nil {
+		return fmt.Errorf("passive health-check: %w", err)
+	}
+
+	if err := s.OutlierDetection.Validate(); err != nil {
+		return fmt.Errorf("outlier detection: %w", err)
+	}
+
+	if err := s.Panic.Validate(); err != nil {
+		return fmt.Errorf("panic: %w", err)
+	}
+
+	if err := s.Conntrack.Validate(); err != nil {
+		return fmt.Errorf("conntrack: %w", err)
+	}
+
+	for _, t := range s.Targets {
+		var paired bool
+
+		if t.Priority < 0 {
+			return fmt.Errorf("target %s: priority must not be negative", t)
+		}
+
+		for _, family := range common.Families {
+			if !bindFamilies[family] || !t.RoutableIn(family) {
+				continue
+			}
+
+			if t.LocalAddress(family) == "" {
+				return fmt.Errorf("target %s: no local address of family %s", t, family)
+			}
+
+			paired = true
+		}
+
+		if !paired {
+			return fmt.Errorf("target %s: address family does not match any bind address", t)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the check definitions and the mode to combine them
+// are consistent
+func (s ServiceHealthCheck) Validate() error {
+	if len(s.Checks) > 0 && (s.Type != "" || s.Settings != nil) {
+		return fmt.Errorf("type / settings and checks are mutually exclusive")
+	}
+
+	switch s.CheckMode() {
+	case CheckModeAll, CheckModeAny:
+	case CheckModeQuorum:
+		if n := len(s.CheckDefinitions()); s.QuorumThreshold() > n {
+			return fmt.Errorf("quorum %d exceeds number of checks %d", s.QuorumThreshold(), n)
+		}
+	default:
+		return fmt.Errorf("unknown mode %q", s.Mode)
+	}
+
+	for i, c := range s.CheckDefinitions() {
+		if c.Type == "" {
+			return fmt.Errorf("check %d: no type given", i+1)
+		}
+	}
+
+	return nil
+}
+
+// LocalAddress returns the local address to use for the SNAT of the
+// target in the given address family: an IP of that family is
+// preferred over a hostname which is resolved when rendering the
+// rules. If none matches an empty string is returned.
+func (t Target) LocalAddress(family string) string {
+	var hostname string
+
+	for _, addr := range t.LocalAddresses() {
+		switch common.AddrFamily(addr) {
+		case family:
+			return addr
+
+		case "":
+			if hostname == "" {
+				hostname = addr
+			}
+		}
+	}
+
+	return hostname
+}
+
+// LocalAddresses returns the localAddr and the additional localAddrs
+// of the target
+func (t Target) LocalAddresses() (addrs []string) {
+	if t.LocalAddr != "" {
+		addrs = append(addrs, t.LocalAddr)
+	}
+
+	return append(addrs, t.LocalAddrs...)
+}
+
+// PriorityTier returns the priority tier of the target: lower values
+// are preferred, backup targets are in tier 1 unless another priority
+// is given
+func (t Target) PriorityTier() int {
+	if t.Backup && t.Priority == 0 {
+		return 1
+	}
+	return t.Priority
+}
+
+// RoutableIn returns whether the target can be routed in the given
+// address family: IPs are only routable in their own family while
+// hostnames are resolved for each family
+func (t Target) RoutableIn(family string) bool {
+	f := common.AddrFamily(t.Addr)
+	return f == "" || f == family
+}
+
+func (t Target) String() string { return net.JoinHostPort(t.Addr, strconv.Itoa(t.Port)) }
@@ -0,0 +1,111 @@
+// Package conntrack contains an abstraction to remove entries from
+// the kernel connection tracking table and to watch its events
+package conntrack
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/common"
+)
+
+type (
+	// Flusher defines the interface to remove the connection tracking
+	// entries of the flows DNATed to a target
+	Flusher interface {
+		FlushTarget(t common.NATTarget) error
+	}
+
+	// Table combines the Flusher and the EventSource as both are
+	// provided by the same implementations
+	Table interface {
+		Flusher
+		EventSource
+	}
+
+	// CLI implements the Table using the conntrack command line
+	// utility
+	CLI struct{}
+
+	// Fake implements the Table by recording the targets it was
+	// asked to flush and emitting the events passed to it without
+	// touching the system
+	Fake struct {
+		lock          sync.Mutex
+		flushed       []common.NATTarget
+		subscriptions []*fakeSubscription
+	}
+
+	fakeSubscription struct {
+		ch     chan Event
+		filter EventFilter
+	}
+)
+
+// NewCLI creates a new Table using the conntrack utility
+func NewCLI() *CLI { return &CLI{} }
+
+// FlushTarget removes all entries of flows sent to the bind address /
+// port of the target and DNATed to the target address / port
+func (CLI) FlushTarget(t common.NATTarget) error {
+	bindAddr, err := common.TranslateToIP(t.BindAddr, t.Family)
+	if err != nil {
+		return fmt.Errorf("resolving bind address: %w", err)
+	}
+
+	targetAddr, err := common.TranslateToIP(t.Addr, t.Family)
+	if err != nil {
+		return fmt.Errorf("resolving target address: %w", err)
+	}
+
+	bin, err := exec.LookPath("conntrack")
+	if err != nil {
+		return fmt.Errorf("finding conntrack binary: %w", err)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(bin, //#nosec:G204 // Path is resolved through LookPath
+		"-D",
+		"-f", t.Family,
+		"-p", t.Proto,
+		"--orig-dst", bindAddr,
+		"--orig-port-dst", strconv.Itoa(t.BindPort),
+		"--reply-src", targetAddr,
+		"--reply-port-src", strconv.Itoa(t.Port),
+	)
+	cmd.Stderr = &stderr
+
+	if err = cmd.Run(); err != nil {
+		// conntrack exits non-zero when there were no entries to delete
+		if strings.Contains(stderr.String(), "0 flow entries") {
+			return nil
+		}
+		return fmt.Errorf("executing conntrack: %w (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// NewFake creates a new Fake Table
+func NewFake() *Fake { return &Fake{} }
+
+// Flushed returns a copy of the targets flushed so far
+func (f *Fake) Flushed() []common.NATTarget {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([]common.NATTarget(nil), f.flushed...)
+}
+
+// FlushTarget records the target to be flushed
+func (f *Fake) FlushTarget(t common.NATTarget) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.flushed = append(f.flushed, t)
+	return nil
+}
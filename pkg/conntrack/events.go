@@ -0,0 +1,233 @@
+package conntrack
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/common"
+	"github.com/sirupsen/logrus"
+)
+
+// Types of the events emitted by the connection tracking
+const (
+	EventNew     = "NEW"
+	EventUpdate  = "UPDATE"
+	EventDestroy = "DESTROY"
+)
+
+const eventBufferSize = 256
+
+type (
+	// EventSource defines the interface to subscribe to the events of
+	// the connection tracking table
+	EventSource interface {
+		Events(ctx context.Context, filter EventFilter) (<-chan Event, error)
+	}
+
+	// Event represents a change of a flow in the connection tracking
+	// table
+	Event struct {
+		Type      string
+		Proto     string
+		State     string
+		Orig      Tuple
+		Reply     Tuple
+		Assured   bool
+		Unreplied bool
+	}
+
+	// EventFilter limits the events to flows of the given family and
+	// protocol sent to the given port
+	EventFilter struct {
+		Family      string
+		Proto       string
+		OrigDstPort int
+	}
+
+	// Tuple describes one direction of a flow
+	Tuple struct {
+		Src     string
+		Dst     string
+		SrcPort int
+		DstPort int
+	}
+)
+
+// Events starts the conntrack utility in event mode and emits the
+// UPDATE and DESTROY events matching the filter until the context is
+// cancelled or the utility exits, closing the channel afterwards
+func (CLI) Events(ctx context.Context, filter EventFilter) (<-chan Event, error) {
+	bin, err := exec.LookPath("conntrack")
+	if err != nil {
+		return nil, fmt.Errorf("finding conntrack binary: %w", err)
+	}
+
+	cmd := exec.CommandContext(ctx, bin, //#nosec:G204 // Path is resolved through LookPath
+		"-E",
+		"-e", strings.Join([]string{EventUpdate, EventDestroy}, ","),
+		"-f", filter.Family,
+		"-p", filter.Proto,
+		"--orig-port-dst", strconv.Itoa(filter.OrigDstPort),
+	)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("getting stdout: %w", err)
+	}
+
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting conntrack: %w", err)
+	}
+
+	events := make(chan Event, eventBufferSize)
+
+	go func() {
+		defer close(events)
+
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			ev, err := ParseEvent(scanner.Text())
+			if err != nil {
+				logrus.WithError(err).Debug("skipping unparsable conntrack event")
+				continue
+			}
+
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+			}
+		}
+
+		if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+			logrus.WithError(err).Error("conntrack event listener exited")
+		}
+	}()
+
+	return events, nil
+}
+
+// Events subscribes to the events passed to Emit matching the filter
+// until the context is cancelled
+func (f *Fake) Events(ctx context.Context, filter EventFilter) (<-chan Event, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	sub := &fakeSubscription{ch: make(chan Event, eventBufferSize), filter: filter}
+	f.subscriptions = append(f.subscriptions, sub)
+
+	go func() {
+		<-ctx.Done()
+
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		for i, s := range f.subscriptions {
+			if s == sub {
+				f.subscriptions = append(f.subscriptions[:i], f.subscriptions[i+1:]...)
+				break
+			}
+		}
+		close(sub.ch)
+	}()
+
+	return sub.ch, nil
+}
+
+// Emit passes the event to all subscribers whose filter matches the
+// address family, protocol and original destination port of the event
+func (f *Fake) Emit(ev Event) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	family := common.AddrFamily(ev.Orig.Dst)
+
+	for _, sub := range f.subscriptions {
+		if sub.filter.Family != family || sub.filter.Proto != ev.Proto || sub.filter.OrigDstPort != ev.Orig.DstPort {
+			continue
+		}
+
+		select {
+		case sub.ch <- ev:
+		default:
+			// Subscriber is not keeping up, the kernel drops events too
+		}
+	}
+}
+
+// ParseEvent parses a line as emitted by `conntrack -E`, for example
+//
+//	[DESTROY] tcp      6 src=192.0.2.1 dst=203.0.113.1 sport=41234 dport=443 [UNREPLIED] src=10.1.2.4 dst=10.1.2.1 sport=443 dport=41234
+func ParseEvent(line string) (ev Event, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "[") || !strings.HasSuffix(fields[0], "]") {
+		return ev, fmt.Errorf("missing event type")
+	}
+
+	ev.Type = strings.Trim(fields[0], "[]")
+	fields = fields[1:]
+
+	// The extended output contains the layer 3 protocol before the
+	// layer 4 protocol
+	if len(fields) > 1 && (fields[0] == "ipv4" || fields[0] == "ipv6") {
+		fields = fields[2:]
+	}
+
+	if len(fields) == 0 {
+		return ev, fmt.Errorf("missing protocol")
+	}
+	ev.Proto = fields[0]
+
+	var tuples [2]Tuple
+	tuple := -1
+
+	for _, field := range fields[1:] {
+		switch field {
+		case "[ASSURED]":
+			ev.Assured = true
+			continue
+		case "[UNREPLIED]":
+			ev.Unreplied = true
+			continue
+		}
+
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			if tuple < 0 && field == strings.ToUpper(field) && strings.Trim(field, "ABCDEFGHIJKLMNOPQRSTUVWXYZ_") == "" {
+				ev.State = field
+			}
+			continue
+		}
+
+		if key == "src" {
+			tuple++
+		}
+		if tuple < 0 || tuple >= len(tuples) {
+			continue
+		}
+
+		switch key {
+		case "src":
+			tuples[tuple].Src = value
+		case "dst":
+			tuples[tuple].Dst = value
+		case "sport":
+			tuples[tuple].SrcPort, err = strconv.Atoi(value)
+		case "dport":
+			tuples[tuple].DstPort, err = strconv.Atoi(value)
+		}
+		if err != nil {
+			return ev, fmt.Errorf("parsing %s: %w", key, err)
+		}
+	}
+
+	if tuple < 1 {
+		return ev, fmt.Errorf("missing original or reply tuple")
+	}
+
+	ev.Orig, ev.Reply = tuples[0], tuples[1]
+	return ev, nil
+}
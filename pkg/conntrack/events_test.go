@@ -0,0 +1,121 @@
+package conntrack
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/common"
+)
+
+func TestParseEvent(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		line string
+		ev   Event
+	}{
+		{
+			name: "unreplied destroy",
+			line: "[DESTROY] tcp      6 src=192.0.2.1 dst=203.0.113.1 sport=41234 dport=443 [UNREPLIED] src=10.1.2.4 dst=10.1.2.1 sport=443 dport=41234",
+			ev: Event{
+				Type:      EventDestroy,
+				Proto:     "tcp",
+				Orig:      Tuple{Src: "192.0.2.1", Dst: "203.0.113.1", SrcPort: 41234, DstPort: 443},
+				Reply:     Tuple{Src: "10.1.2.4", Dst: "10.1.2.1", SrcPort: 443, DstPort: 41234},
+				Unreplied: true,
+			},
+		},
+		{
+			name: "extended assured update",
+			line: " [UPDATE] ipv4     2 tcp      6 10 CLOSE src=192.0.2.1 dst=203.0.113.1 sport=41234 dport=443 src=10.1.2.4 dst=10.1.2.1 sport=443 dport=41234 [ASSURED]",
+			ev: Event{
+				Type:    EventUpdate,
+				Proto:   "tcp",
+				State:   "CLOSE",
+				Orig:    Tuple{Src: "192.0.2.1", Dst: "203.0.113.1", SrcPort: 41234, DstPort: 443},
+				Reply:   Tuple{Src: "10.1.2.4", Dst: "10.1.2.1", SrcPort: 443, DstPort: 41234},
+				Assured: true,
+			},
+		},
+		{
+			name: "extended IPv6 udp",
+			line: "[DESTROY] ipv6     10 udp      17 src=2001:db8::1 dst=2001:db8::2 sport=5353 dport=53 src=2001:db8::5 dst=2001:db8::a sport=53 dport=5353",
+			ev: Event{
+				Type:  EventDestroy,
+				Proto: "udp",
+				Orig:  Tuple{Src: "2001:db8::1", Dst: "2001:db8::2", SrcPort: 5353, DstPort: 53},
+				Reply: Tuple{Src: "2001:db8::5", Dst: "2001:db8::a", SrcPort: 53, DstPort: 5353},
+			},
+		},
+	} {
+		ev, err := ParseEvent(tc.line)
+		if err != nil {
+			t.Errorf("%s: parsing event: %s", tc.name, err)
+			continue
+		}
+
+		if ev != tc.ev {
+			t.Errorf("%s: unexpected event:\n%+v\nexpected:\n%+v", tc.name, ev, tc.ev)
+		}
+	}
+}
+
+func TestParseEventInvalid(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"tcp 6 src=192.0.2.1 dst=203.0.113.1 sport=41234 dport=443",
+		"[DESTROY]",
+		"[DESTROY] tcp 6 src=192.0.2.1 dst=203.0.113.1 sport=41234 dport=443",
+		"[DESTROY] tcp 6 src=192.0.2.1 dst=203.0.113.1 sport=abc dport=443 src=10.1.2.4 dst=10.1.2.1 sport=443 dport=41234",
+	} {
+		if _, err := ParseEvent(line); err == nil {
+			t.Errorf("expected error for line %q", line)
+		}
+	}
+}
+
+func TestFakeEmitFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := NewFake()
+
+	subscribe := func(family string) <-chan Event {
+		ch, err := f.Events(ctx, EventFilter{Family: family, Proto: "tcp", OrigDstPort: 443})
+		if err != nil {
+			t.Fatalf("subscribing: %s", err)
+		}
+		return ch
+	}
+
+	var (
+		v4 = subscribe(common.FamilyIPv4)
+		v6 = subscribe(common.FamilyIPv6)
+	)
+
+	for _, ev := range []Event{
+		{Proto: "tcp", Orig: Tuple{Dst: "203.0.113.1", DstPort: 443}},
+		{Proto: "udp", Orig: Tuple{Dst: "203.0.113.1", DstPort: 443}},
+		{Proto: "tcp", Orig: Tuple{Dst: "203.0.113.1", DstPort: 80}},
+		{Proto: "tcp", Orig: Tuple{Dst: "2001:db8::1", DstPort: 443}},
+	} {
+		f.Emit(ev)
+	}
+
+	for dst, ch := range map[string]<-chan Event{"203.0.113.1": v4, "2001:db8::1": v6} {
+		select {
+		case ev := <-ch:
+			if ev.Orig.Dst != dst {
+				t.Errorf("received event for %s on subscription for %s", ev.Orig.Dst, dst)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event received for %s", dst)
+		}
+
+		select {
+		case ev := <-ch:
+			t.Errorf("received unexpected event %+v", ev)
+		default:
+		}
+	}
+}
@@ -1,6 +1,12 @@
 // Package common contains some helpers used in multiple checks
 package common
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
 type (
 	// SettingHelp is used to render a help for check config
 	SettingHelp struct {
@@ -9,3 +15,55 @@ type (
 		Description string
 	}
 )
+
+// Roles a database target can be required to have
+const (
+	RoleAny     = ""
+	RolePrimary = "primary"
+	RoleReplica = "replica"
+)
+
+// CheckRole validates the given role is known and, if a role is
+// required, the target having the given primary state matches it
+func CheckRole(required string, isPrimary bool) error {
+	switch required {
+	case RoleAny:
+		return nil
+
+	case RolePrimary:
+		if !isPrimary {
+			return errors.New("target is not a primary")
+		}
+		return nil
+
+	case RoleReplica:
+		if isPrimary {
+			return errors.New("target is not a replica")
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown role %q", required)
+	}
+}
+
+// ValidateRole checks the given role is known
+func ValidateRole(role string) error {
+	switch role {
+	case RoleAny, RolePrimary, RoleReplica:
+		return nil
+	default:
+		return fmt.Errorf("unknown role %q", role)
+	}
+}
+
+// SplitKeyValue splits a setting entry in the form 'key: value' into
+// its trimmed key and value
+func SplitKeyValue(entry string) (key, value string, err error) {
+	key, value, ok := strings.Cut(entry, ":")
+	if !ok {
+		return "", "", fmt.Errorf("invalid entry %q, expected 'key: value'", entry)
+	}
+
+	return strings.TrimSpace(key), strings.TrimSpace(value), nil
+}
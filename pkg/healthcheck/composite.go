@@ -0,0 +1,148 @@
+package healthcheck
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+)
+
+type (
+	// Composite executes all checks defined for a service against a
+	// target and combines their results according to the check mode
+	Composite struct {
+		checks []compositeCheck
+		mode   string
+		quorum int
+	}
+
+	// CheckError is returned by the Composite when the combined checks
+	// failed and contains the names of the failed checks
+	CheckError struct {
+		Failed []string
+
+		errs      []error
+		required  int
+		succeeded int
+		total     int
+	}
+
+	// ObserveFunc is called for every executed check with the type of
+	// the check, its duration and its result
+	ObserveFunc func(checkType string, duration time.Duration, err error)
+
+	compositeCheck struct {
+		checker Checker
+		def     config.HealthCheck
+		name    string
+	}
+)
+
+// NewComposite resolves the checks defined in the given health-check
+// configuration and returns an error if any of them is not registered
+func NewComposite(hc config.ServiceHealthCheck) (*Composite, error) {
+	c := &Composite{mode: hc.CheckMode()}
+
+	defs := hc.CheckDefinitions()
+	for i, def := range defs {
+		checker := ByName(def.Type)
+		if checker == nil {
+			return nil, fmt.Errorf("checker %q not found", def.Type)
+		}
+
+		name := def.Name
+		switch {
+		case name != "":
+		case len(defs) == 1:
+			name = def.Type
+		default:
+			name = fmt.Sprintf("%s#%d", def.Type, i+1)
+		}
+
+		c.checks = append(c.checks, compositeCheck{checker: checker, def: def, name: name})
+	}
+
+	switch c.mode {
+	case config.CheckModeAll:
+		c.quorum = len(c.checks)
+	case config.CheckModeAny:
+		c.quorum = 1
+	case config.CheckModeQuorum:
+		c.quorum = hc.QuorumThreshold()
+	default:
+		return nil, fmt.Errorf("unknown mode %q", c.mode)
+	}
+
+	return c, nil
+}
+
+// Check executes all checks in parallel against the given target and
+// returns a *CheckError if not enough of them succeeded. The observe
+// function may be nil.
+func (c *Composite) Check(target config.Target, observe ObserveFunc) error {
+	var (
+		results = make([]error, len(c.checks))
+		wg      sync.WaitGroup
+	)
+	wg.Add(len(c.checks))
+
+	for i := range c.checks {
+		check := c.checks[i]
+		go func() {
+			defer wg.Done()
+
+			t := target
+			if check.def.Port > 0 {
+				t.Port = check.def.Port
+			}
+
+			checkStart := time.Now()
+			results[i] = check.checker.Check(check.def.Settings, t)
+			if observe != nil {
+				observe(check.def.Type, time.Since(checkStart), results[i])
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	cErr := &CheckError{required: c.quorum, total: len(c.checks)}
+	for i, err := range results {
+		if err == nil {
+			cErr.succeeded++
+			continue
+		}
+
+		cErr.Failed = append(cErr.Failed, c.checks[i].name)
+		cErr.errs = append(cErr.errs, fmt.Errorf("%s: %w", c.checks[i].name, err))
+	}
+
+	if cErr.succeeded >= cErr.required {
+		return nil
+	}
+
+	return cErr
+}
+
+func (e *CheckError) Error() string {
+	if e.total == 1 && len(e.errs) == 1 {
+		// Keep the message of a single check as it was
+		return errors.Unwrap(e.errs[0]).Error()
+	}
+
+	msgs := make([]string, 0, len(e.errs))
+	for _, err := range e.errs {
+		msgs = append(msgs, err.Error())
+	}
+
+	return fmt.Sprintf(
+		"%d/%d checks succeeded, %d required: %s",
+		e.succeeded, e.total, e.required, strings.Join(msgs, "; "),
+	)
+}
+
+// Unwrap returns the errors of the failed checks
+func (e *CheckError) Unwrap() []error { return e.errs }
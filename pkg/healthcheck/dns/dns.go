@@ -0,0 +1,247 @@
+// Package dns contains a health-check to verify a DNS server is
+// answering queries over UDP or TCP
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/healthcheck/common"
+	"github.com/Luzifer/go_helpers/v2/fieldcollection"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	settingAnswer    = "answer"
+	settingName      = "name"
+	settingPort      = "port"
+	settingRcode     = "rcode"
+	settingRecursion = "recursion"
+	settingTimeout   = "timeout"
+	settingTransport = "transport"
+	settingType      = "type"
+)
+
+const maxUDPMessageSize = 4096
+
+type (
+	// Check represents the DNS check
+	Check struct{}
+)
+
+var (
+	defAnswer    = ""
+	defName      = "."
+	defRcode     = "NOERROR"
+	defRecursion = true
+	defTimeout   = time.Second
+	defTransport = "udp"
+	defType      = "A"
+)
+
+var (
+	queryTypes = map[string]dnsmessage.Type{
+		"A":     dnsmessage.TypeA,
+		"AAAA":  dnsmessage.TypeAAAA,
+		"CNAME": dnsmessage.TypeCNAME,
+		"MX":    dnsmessage.TypeMX,
+		"NS":    dnsmessage.TypeNS,
+		"PTR":   dnsmessage.TypePTR,
+		"SOA":   dnsmessage.TypeSOA,
+		"SRV":   dnsmessage.TypeSRV,
+		"TXT":   dnsmessage.TypeTXT,
+	}
+
+	rcodes = map[string]dnsmessage.RCode{
+		"FORMERR":  dnsmessage.RCodeFormatError,
+		"NOERROR":  dnsmessage.RCodeSuccess,
+		"NOTIMP":   dnsmessage.RCodeNotImplemented,
+		"NXDOMAIN": dnsmessage.RCodeNameError,
+		"REFUSED":  dnsmessage.RCodeRefused,
+		"SERVFAIL": dnsmessage.RCodeServerFailure,
+	}
+)
+
+// New returns a new DNS check
+func New() Check { return Check{} }
+
+// Check executes the check
+func (c Check) Check(settings *fieldcollection.FieldCollection, target config.Target) error {
+	qType, ok := queryTypes[strings.ToUpper(settings.MustString(settingType, &defType))]
+	if !ok {
+		return fmt.Errorf("unsupported query type %q", settings.MustString(settingType, &defType))
+	}
+
+	rcode, ok := rcodes[strings.ToUpper(settings.MustString(settingRcode, &defRcode))]
+	if !ok {
+		return fmt.Errorf("unsupported rcode %q", settings.MustString(settingRcode, &defRcode))
+	}
+
+	var answerMatch *regexp.Regexp
+	if expr := settings.MustString(settingAnswer, &defAnswer); expr != defAnswer {
+		var err error
+		if answerMatch, err = regexp.Compile(expr); err != nil {
+			return fmt.Errorf("parsing answer expression: %w", err)
+		}
+	}
+
+	transport := strings.ToLower(settings.MustString(settingTransport, &defTransport))
+	if transport != "tcp" && transport != "udp" {
+		return fmt.Errorf("unsupported transport %q", transport)
+	}
+
+	name := settings.MustString(settingName, &defName)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	qName, err := dnsmessage.NewName(name)
+	if err != nil {
+		return fmt.Errorf("parsing query name: %w", err)
+	}
+
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               uint16(rand.Uint32()), //#nosec:G404 // The ID only needs to match the response
+			RecursionDesired: settings.MustBool(settingRecursion, &defRecursion),
+		},
+		Questions: []dnsmessage.Question{{Name: qName, Type: qType, Class: dnsmessage.ClassINET}},
+	}
+
+	packed, err := query.Pack()
+	if err != nil {
+		return fmt.Errorf("packing query: %w", err)
+	}
+
+	timeout := settings.MustDuration(settingTimeout, &defTimeout)
+	conn, err := net.DialTimeout(
+		transport,
+		net.JoinHostPort(target.Addr, strconv.FormatInt(settings.MustInt64(settingPort, c.intToInt64Ptr(target.Port)), 10)),
+		timeout,
+	)
+	if err != nil {
+		return fmt.Errorf("dialing %s: %w", transport, err)
+	}
+	defer conn.Close() //nolint:errcheck
+
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return fmt.Errorf("setting deadline: %w", err)
+	}
+
+	raw, err := c.exchange(conn, transport, packed)
+	if err != nil {
+		return err
+	}
+
+	var resp dnsmessage.Message
+	if err = resp.Unpack(raw); err != nil {
+		return fmt.Errorf("parsing response: %w", err)
+	}
+
+	if resp.ID != query.ID {
+		return fmt.Errorf("response ID %d does not match query ID %d", resp.ID, query.ID)
+	}
+
+	if resp.RCode != rcode {
+		return fmt.Errorf("unexpected rcode %s != %s", resp.RCode, rcode)
+	}
+
+	if answerMatch == nil {
+		return nil
+	}
+
+	for _, a := range resp.Answers {
+		if answerMatch.MatchString(c.answerString(a.Body)) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no answer matching %q found", answerMatch.String())
+}
+
+// Help returns the set of settings used in the check
+func (Check) Help() (help []common.SettingHelp) {
+	return []common.SettingHelp{
+		{Name: settingAnswer, Default: defAnswer, Description: "Regular expression one of the answers must match (IP for A / AAAA, name for CNAME / NS / PTR, 'pref host' for MX, 'prio weight port target' for SRV, text for TXT, primary NS for SOA)"},
+		{Name: settingName, Default: defName, Description: "Name to query"},
+		{Name: settingPort, Default: "target-port", Description: "Port to send the query to"},
+		{Name: settingRcode, Default: defRcode, Description: "Response code to expect (NOERROR, NXDOMAIN, SERVFAIL, REFUSED, FORMERR, NOTIMP)"},
+		{Name: settingRecursion, Default: defRecursion, Description: "Request recursion for the query"},
+		{Name: settingTimeout, Default: defTimeout, Description: "Timeout for the query"},
+		{Name: settingTransport, Default: defTransport, Description: "Transport to send the query over (udp, tcp)"},
+		{Name: settingType, Default: defType, Description: "Record type to query (A, AAAA, CNAME, MX, NS, PTR, SOA, SRV, TXT)"},
+	}
+}
+
+func (Check) answerString(body dnsmessage.ResourceBody) string {
+	switch b := body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(b.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		return net.IP(b.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		return b.CNAME.String()
+	case *dnsmessage.MXResource:
+		return fmt.Sprintf("%d %s", b.Pref, b.MX)
+	case *dnsmessage.NSResource:
+		return b.NS.String()
+	case *dnsmessage.PTRResource:
+		return b.PTR.String()
+	case *dnsmessage.SOAResource:
+		return b.NS.String()
+	case *dnsmessage.SRVResource:
+		return fmt.Sprintf("%d %d %d %s", b.Priority, b.Weight, b.Port, b.Target)
+	case *dnsmessage.TXTResource:
+		return strings.Join(b.TXT, "")
+	default:
+		return body.GoString()
+	}
+}
+
+// exchange sends the query and reads the response: over TCP messages
+// are prefixed with their length
+func (Check) exchange(conn net.Conn, transport string, query []byte) ([]byte, error) {
+	if transport == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, fmt.Errorf("sending query: %w", err)
+		}
+
+		buf := make([]byte, maxUDPMessageSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, fmt.Errorf("reading response: %w", err)
+		}
+
+		return buf[:n], nil
+	}
+
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query))) //#nosec:G115 // Query is way shorter than 64k
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, fmt.Errorf("sending query: %w", err)
+	}
+
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, fmt.Errorf("reading response length: %w", err)
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+
+	return buf, nil
+}
+
+func (Check) intToInt64Ptr(i int) *int64 {
+	i64 := int64(i)
+	return &i64
+}
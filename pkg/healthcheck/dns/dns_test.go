@@ -0,0 +1,134 @@
+package dns
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"github.com/Luzifer/go_helpers/v2/fieldcollection"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// answer responds to queries for example.com. with an A and a MX
+// record and with NXDOMAIN to all other names
+func answer(t *testing.T, query []byte) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		t.Errorf("parsing query: %s", err)
+		return nil
+	}
+
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: msg.ID, Response: true},
+		Questions: msg.Questions,
+	}
+
+	q := msg.Questions[0]
+	hdr := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+
+	switch {
+	case q.Name.String() != "example.com.":
+		resp.RCode = dnsmessage.RCodeNameError
+
+	case q.Type == dnsmessage.TypeA:
+		resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}})
+
+	case q.Type == dnsmessage.TypeMX:
+		resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.MXResource{Pref: 10, MX: dnsmessage.MustNewName("mail.example.com.")}})
+	}
+
+	packed, err := resp.Pack()
+	if err != nil {
+		t.Errorf("packing response: %s", err)
+	}
+
+	return packed
+}
+
+func serveUDP(t *testing.T) int {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening udp: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() }) //nolint:errcheck,gosec
+
+	go func() {
+		buf := make([]byte, maxUDPMessageSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(answer(t, buf[:n]), addr) //nolint:errcheck,gosec
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func serveTCP(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening tcp: %s", err)
+	}
+	t.Cleanup(func() { l.Close() }) //nolint:errcheck,gosec
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			var length uint16
+			if err = binary.Read(conn, binary.BigEndian, &length); err == nil {
+				query := make([]byte, length)
+				if _, err = io.ReadFull(conn, query); err == nil {
+					resp := answer(t, query)
+					conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...)) //nolint:errcheck,gosec
+				}
+			}
+			conn.Close() //nolint:errcheck,gosec
+		}
+	}()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestCheck(t *testing.T) {
+	var (
+		target  = config.Target{Addr: "127.0.0.1", Port: serveUDP(t)}
+		tcpPort = serveTCP(t)
+	)
+
+	for _, tc := range []struct {
+		name     string
+		settings map[string]any
+		err      string
+	}{
+		{"A answer", map[string]any{settingName: "example.com", settingAnswer: `^192\.0\.2\.1$`}, ""},
+		{"A answer over tcp", map[string]any{settingName: "example.com", settingAnswer: `^192\.0\.2\.1$`, settingTransport: "tcp", settingPort: tcpPort}, ""},
+		{"MX answer", map[string]any{settingName: "example.com.", settingType: "mx", settingAnswer: `^10 mail\.example\.com\.$`}, ""},
+		{"answer mismatch", map[string]any{settingName: "example.com", settingAnswer: `^192\.0\.2\.2$`}, "no answer matching"},
+		{"no answers", map[string]any{settingName: "example.com", settingType: "TXT", settingAnswer: `.`}, "no answer matching"},
+		{"unexpected rcode", map[string]any{settingName: "missing.example.com"}, "unexpected rcode"},
+		{"expected rcode", map[string]any{settingName: "missing.example.com", settingRcode: "nxdomain"}, ""},
+		{"unknown type", map[string]any{settingType: "BOGUS"}, "unsupported query type"},
+		{"unknown rcode", map[string]any{settingRcode: "BOGUS"}, "unsupported rcode"},
+		{"unknown transport", map[string]any{settingTransport: "sctp"}, "unsupported transport"},
+		{"invalid answer expression", map[string]any{settingAnswer: "("}, "parsing answer expression"},
+	} {
+		err := New().Check(fieldcollection.FieldCollectionFromData(tc.settings), target)
+
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.err, err)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Package exec contains a health-check executing a custom command to
+// verify the target is alive
+package exec
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/healthcheck/common"
+	"github.com/Luzifer/go_helpers/v2/fieldcollection"
+)
+
+const (
+	settingCommand        = "command"
+	settingConcurrency    = "concurrency"
+	settingExpectExitCode = "expectExitCode"
+	settingExpectOutput   = "expectOutput"
+	settingPort           = "port"
+	settingTimeout        = "timeout"
+)
+
+// Environment variables passed to the command
+const (
+	envTarget     = "IPTLB_TARGET"
+	envTargetAddr = "IPTLB_TARGET_ADDR"
+	envTargetPort = "IPTLB_TARGET_PORT"
+)
+
+// waitDelay is the time given to the command to close its output
+// after it has been killed on timeout
+const waitDelay = time.Second
+
+type (
+	// Check represents the exec check
+	Check struct{}
+)
+
+var (
+	defCommand        = []string{}
+	defConcurrency    = int64(4)
+	defExpectExitCode = int64(0)
+	defExpectOutput   = ""
+	defTimeout        = 5 * time.Second
+)
+
+var (
+	// slots limits the concurrent executions of the same command to
+	// prevent spawning one process per target at the same time
+	slots     = map[string]chan struct{}{}
+	slotsLock sync.Mutex
+)
+
+// New returns a new exec check
+func New() Check { return Check{} }
+
+// Check executes the check
+func (c Check) Check(settings *fieldcollection.FieldCollection, target config.Target) (err error) {
+	command := settings.MustStringSlice(settingCommand, &defCommand)
+	if len(command) == 0 {
+		return errors.New("no command given")
+	}
+
+	var outputMatch *regexp.Regexp
+	if expr := settings.MustString(settingExpectOutput, &defExpectOutput); expr != defExpectOutput {
+		if outputMatch, err = regexp.Compile(expr); err != nil {
+			return fmt.Errorf("parsing output expression: %w", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), settings.MustDuration(settingTimeout, &defTimeout))
+	defer cancel()
+
+	release, err := c.acquireSlot(ctx, command, settings.MustInt64(settingConcurrency, &defConcurrency))
+	if err != nil {
+		return fmt.Errorf("waiting for execution slot: %w", err)
+	}
+	defer release()
+
+	port := strconv.FormatInt(settings.MustInt64(settingPort, c.intToInt64Ptr(target.Port)), 10)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...) //#nosec:G204 // The intention is to run a configured command
+	cmd.Env = append(os.Environ(),
+		envTarget+"="+net.JoinHostPort(target.Addr, port),
+		envTargetAddr+"="+target.Addr,
+		envTargetPort+"="+port,
+	)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = waitDelay
+
+	exitCode := 0
+	if err = cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if ctx.Err() != nil {
+			return fmt.Errorf("executing command: %w (%w)", ctx.Err(), err)
+		}
+		if !errors.As(err, &exitErr) {
+			return fmt.Errorf("executing command: %w", err)
+		}
+		exitCode = exitErr.ExitCode()
+	}
+
+	if int64(exitCode) != settings.MustInt64(settingExpectExitCode, &defExpectExitCode) {
+		return fmt.Errorf(
+			"unexpected exit code %d != %d (%s)",
+			exitCode, settings.MustInt64(settingExpectExitCode, &defExpectExitCode), strings.TrimSpace(stderr.String()),
+		)
+	}
+
+	if outputMatch != nil && !outputMatch.Match(stdout.Bytes()) {
+		return fmt.Errorf("output does not match %q", outputMatch.String())
+	}
+
+	return nil
+}
+
+// Help returns the set of settings used in the check
+func (Check) Help() (help []common.SettingHelp) {
+	return []common.SettingHelp{
+		{Name: settingCommand, Default: defCommand, Description: "Command and arguments to execute, the target is passed in the " + envTarget + ", " + envTargetAddr + " and " + envTargetPort + " environment variables"},
+		{Name: settingConcurrency, Default: defConcurrency, Description: "Maximum number of concurrent executions of the command"},
+		{Name: settingExpectExitCode, Default: defExpectExitCode, Description: "Exit code to expect from the command"},
+		{Name: settingExpectOutput, Default: defExpectOutput, Description: "Regular expression the output of the command must match"},
+		{Name: settingPort, Default: "target-port", Description: "Port to pass to the command"},
+		{Name: settingTimeout, Default: defTimeout, Description: "Timeout for the execution including the wait for an execution slot"},
+	}
+}
+
+// acquireSlot waits for a free execution slot of the given command
+// and returns the function to release it again
+func (Check) acquireSlot(ctx context.Context, command []string, limit int64) (func(), error) {
+	if limit < 1 {
+		limit = 1
+	}
+
+	key := fmt.Sprintf("%d:%s", limit, strings.Join(command, "\x00"))
+
+	slotsLock.Lock()
+	slot, ok := slots[key]
+	if !ok {
+		slot = make(chan struct{}, limit)
+		slots[key] = slot
+	}
+	slotsLock.Unlock()
+
+	select {
+	case slot <- struct{}{}:
+		return func() { <-slot }, nil
+
+	case <-ctx.Done():
+		return nil, ctx.Err() //nolint:wrapcheck // Wrapped by caller
+	}
+}
+
+func (Check) intToInt64Ptr(i int) *int64 {
+	i64 := int64(i)
+	return &i64
+}
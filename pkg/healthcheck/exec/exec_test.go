@@ -0,0 +1,94 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"github.com/Luzifer/go_helpers/v2/fieldcollection"
+)
+
+func TestCheck(t *testing.T) {
+	target := config.Target{Addr: "127.0.0.1", Port: 8080}
+
+	sh := func(script string) []any { return []any{"/bin/sh", "-c", script} }
+
+	for _, tc := range []struct {
+		name     string
+		settings map[string]any
+		err      string
+	}{
+		{"success", map[string]any{settingCommand: sh("exit 0")}, ""},
+		{"target in environment", map[string]any{
+			settingCommand:      sh(`echo "$IPTLB_TARGET $IPTLB_TARGET_ADDR $IPTLB_TARGET_PORT"`),
+			settingExpectOutput: `^127\.0\.0\.1:8080 127\.0\.0\.1 8080\n$`,
+		}, ""},
+		{"port override", map[string]any{
+			settingCommand:      sh(`echo "$IPTLB_TARGET"`),
+			settingExpectOutput: `^127\.0\.0\.1:9090\n$`,
+			settingPort:         9090,
+		}, ""},
+		{"unexpected exit code", map[string]any{settingCommand: sh("echo broken >&2; exit 2")}, "unexpected exit code 2 != 0 (broken)"},
+		{"expected exit code", map[string]any{settingCommand: sh("exit 2"), settingExpectExitCode: 2}, ""},
+		{"output mismatch", map[string]any{settingCommand: sh("echo degraded"), settingExpectOutput: "^ok"}, "output does not match"},
+		{"timeout", map[string]any{settingCommand: sh("exec sleep 5"), settingTimeout: "100ms"}, "context deadline exceeded"},
+		{"no command", map[string]any{}, "no command given"},
+		{"unknown command", map[string]any{settingCommand: []any{"/nonexistent/check"}}, "executing command"},
+		{"invalid expression", map[string]any{settingCommand: sh("exit 0"), settingExpectOutput: "("}, "parsing output expression"},
+	} {
+		err := New().Check(fieldcollection.FieldCollectionFromData(tc.settings), target)
+
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestAcquireSlot(t *testing.T) {
+	var (
+		c       = New()
+		command = []string{"/bin/true", t.Name()}
+	)
+
+	release, err := c.acquireSlot(context.Background(), command, 1)
+	if err != nil {
+		t.Fatalf("acquiring first slot: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err = c.acquireSlot(ctx, command, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected second execution to wait for the slot, got %v", err)
+	}
+
+	// Other limits and commands do not share the slot
+	for _, other := range []struct {
+		command []string
+		limit   int64
+	}{
+		{command, 2},
+		{[]string{"/bin/false"}, 1},
+	} {
+		otherRelease, err := c.acquireSlot(context.Background(), other.command, other.limit)
+		if err != nil {
+			t.Errorf("acquiring slot of %v (limit %d): %s", other.command, other.limit, err)
+			continue
+		}
+		otherRelease()
+	}
+
+	release()
+
+	if release, err = c.acquireSlot(context.Background(), command, 1); err != nil {
+		t.Fatalf("acquiring released slot: %s", err)
+	}
+	release()
+}
@@ -0,0 +1,113 @@
+// Package grpc contains a health-check using the gRPC health-checking
+// protocol (grpc.health.v1.Health)
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/healthcheck/common"
+	"github.com/Luzifer/go_helpers/v2/fieldcollection"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	settingInsecureTLS = "insecureTLS"
+	settingMetadata    = "metadata"
+	settingPort        = "port"
+	settingServerName  = "serverName"
+	settingService     = "service"
+	settingTimeout     = "timeout"
+	settingTLS         = "tls"
+)
+
+type (
+	// Check represents the gRPC check
+	Check struct{}
+)
+
+var (
+	defInsecureTLS = false
+	defMetadata    = []string{}
+	defServerName  = ""
+	defService     = ""
+	defTimeout     = time.Second
+	defTLS         = false
+)
+
+// New returns a new gRPC check
+func New() Check { return Check{} }
+
+// Check executes the check
+func (c Check) Check(settings *fieldcollection.FieldCollection, target config.Target) error {
+	md := metadata.MD{}
+	for _, entry := range settings.MustStringSlice(settingMetadata, &defMetadata) {
+		key, value, err := common.SplitKeyValue(entry)
+		if err != nil {
+			return fmt.Errorf("parsing metadata: %w", err)
+		}
+		md.Append(key, value)
+	}
+
+	creds := insecure.NewCredentials()
+	if settings.MustBool(settingTLS, &defTLS) {
+		creds = credentials.NewTLS(&tls.Config{
+			InsecureSkipVerify: settings.MustBool(settingInsecureTLS, &defInsecureTLS), //#nosec:G402 // The intention is to allow insecure TLS
+			ServerName:         settings.MustString(settingServerName, &defServerName),
+		})
+	}
+
+	conn, err := grpc.NewClient(
+		net.JoinHostPort(target.Addr, strconv.FormatInt(settings.MustInt64(settingPort, c.intToInt64Ptr(target.Port)), 10)),
+		grpc.WithTransportCredentials(creds),
+		grpc.WithUserAgent("ipt-loadbalancer/v1 (https://git.luzifer.io/luzifer/ipt-loadbalancer)"),
+	)
+	if err != nil {
+		return fmt.Errorf("creating client: %w", err)
+	}
+	defer conn.Close() //nolint:errcheck
+
+	ctx, cancel := context.WithTimeout(context.Background(), settings.MustDuration(settingTimeout, &defTimeout))
+	defer cancel()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(
+		metadata.NewOutgoingContext(ctx, md),
+		&healthpb.HealthCheckRequest{Service: settings.MustString(settingService, &defService)},
+	)
+	if err != nil {
+		return fmt.Errorf("executing health check: %w", err)
+	}
+
+	if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("unexpected serving status %s", resp.GetStatus())
+	}
+
+	return nil
+}
+
+// Help returns the set of settings used in the check
+func (Check) Help() (help []common.SettingHelp) {
+	return []common.SettingHelp{
+		{Name: settingInsecureTLS, Default: defInsecureTLS, Description: "Skip TLS certificate validation"},
+		{Name: settingMetadata, Default: defMetadata, Description: "Metadata to send with the request as list of 'key: value' entries"},
+		{Name: settingPort, Default: "target-port", Description: "Port to send the request to"},
+		{Name: settingServerName, Default: defServerName, Description: "Server name to use for TLS"},
+		{Name: settingService, Default: defService, Description: "Service name to check (empty for the overall server health)"},
+		{Name: settingTimeout, Default: defTimeout, Description: "Timeout for the request"},
+		{Name: settingTLS, Default: defTLS, Description: "Connect to the server using TLS"},
+	}
+}
+
+func (Check) intToInt64Ptr(i int) *int64 {
+	i64 := int64(i)
+	return &i64
+}
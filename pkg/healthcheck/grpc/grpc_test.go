@@ -0,0 +1,90 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"github.com/Luzifer/go_helpers/v2/fieldcollection"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestCheck(t *testing.T) {
+	var (
+		mdLock   sync.Mutex
+		received metadata.MD
+	)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+
+	srv := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		mdLock.Lock()
+		received, _ = metadata.FromIncomingContext(ctx)
+		mdLock.Unlock()
+
+		return handler(ctx, req)
+	}))
+	defer srv.Stop()
+
+	hs := health.NewServer()
+	hs.SetServingStatus("serving", healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("down", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(srv, hs)
+
+	go srv.Serve(l) //nolint:errcheck
+
+	target := config.Target{Addr: "127.0.0.1", Port: l.Addr().(*net.TCPAddr).Port}
+
+	for _, tc := range []struct {
+		service string
+		err     string
+	}{
+		{"", ""},
+		{"serving", ""},
+		{"down", "unexpected serving status NOT_SERVING"},
+		{"unknown", "NotFound"},
+	} {
+		err := New().Check(fieldcollection.FieldCollectionFromData(map[string]any{
+			settingService:  tc.service,
+			settingMetadata: []any{"x-check: ipt-loadbalancer"},
+		}), target)
+
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("service %q: unexpected error: %s", tc.service, err)
+
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("service %q: expected error containing %q, got %v", tc.service, tc.err, err)
+		}
+	}
+
+	mdLock.Lock()
+	defer mdLock.Unlock()
+
+	if v := received.Get("x-check"); len(v) != 1 || v[0] != "ipt-loadbalancer" {
+		t.Errorf("expected metadata to be sent, got %v", received)
+	}
+}
+
+func TestCheckUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close() //nolint:errcheck,gosec
+
+	if err = New().Check(fieldcollection.NewFieldCollection(), config.Target{Addr: "127.0.0.1", Port: port}); err == nil {
+		t.Error("expected error for unreachable target")
+	}
+}
@@ -4,10 +4,14 @@ package http
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,33 +21,61 @@ import (
 )
 
 const (
-	settingCode          = "code"
-	settingExpectContent = "expectContent"
-	settingHost          = "host"
-	settingInsecureTLS   = "insecureTLS"
-	settingMethod        = "method"
-	settingPath          = "path"
-	settingPort          = "port"
-	settingTimeout       = "timeout"
-	settingTLS           = "tls"
+	settingBody            = "body"
+	settingClientCert      = "clientCert"
+	settingClientKey       = "clientKey"
+	settingCode            = "code"
+	settingCodes           = "codes"
+	settingExpectContent   = "expectContent"
+	settingExpectHeaders   = "expectHeaders"
+	settingExpectJSON      = "expectJSON"
+	settingExpectRegex     = "expectRegex"
+	settingFollowRedirects = "followRedirects"
+	settingHeaders         = "headers"
+	settingHost            = "host"
+	settingInsecureTLS     = "insecureTLS"
+	settingMaxRedirects    = "maxRedirects"
+	settingMethod          = "method"
+	settingPath            = "path"
+	settingPort            = "port"
+	settingServerName      = "serverName"
+	settingTimeout         = "timeout"
+	settingTLS             = "tls"
 )
 
+// maxBodySize limits the amount of the response body read for the
+// content assertions
+const maxBodySize = 1 << 20
+
 type (
 	// Check represents the HTTP check
 	Check struct{}
 )
 
 var (
-	defCode          = http.StatusOK
-	defExpectContent = ""
-	defHost          = ""
-	defInsecureTLS   = false
-	defMethod        = http.MethodGet
-	defPath          = "/"
-	defTimeout       = time.Second
-	defTLS           = false
+	defBody            = ""
+	defClientCert      = ""
+	defClientKey       = ""
+	defCode            = http.StatusOK
+	defCodes           = []string{}
+	defExpectContent   = ""
+	defExpectHeaders   = []string{}
+	defExpectJSON      = []string{}
+	defExpectRegex     = ""
+	defFollowRedirects = true
+	defHeaders         = []string{}
+	defHost            = ""
+	defInsecureTLS     = false
+	defMaxRedirects    = int64(10)
+	defMethod          = http.MethodGet
+	defPath            = "/"
+	defServerName      = ""
+	defTimeout         = time.Second
+	defTLS             = false
 )
 
+var statusClass = regexp.MustCompile(`^([1-5])xx$`)
+
 // New returns a new HTTP check
 func New() Check { return Check{} }
 
@@ -54,7 +86,7 @@ func (c Check) Check(settings *fieldcollection.FieldCollection, target config.Ta
 
 	u := url.URL{
 		Scheme: "http",
-		Host:   fmt.Sprintf("%s:%d", target.Addr, settings.MustInt64(settingPort, c.intToInt64Ptr(target.Port))),
+		Host:   net.JoinHostPort(target.Addr, strconv.FormatInt(settings.MustInt64(settingPort, c.intToInt64Ptr(target.Port)), 10)),
 		Path:   settings.MustString(settingPath, &defPath),
 	}
 
@@ -62,23 +94,46 @@ func (c Check) Check(settings *fieldcollection.FieldCollection, target config.Ta
 		u.Scheme = "https"
 	}
 
-	req, err := http.NewRequestWithContext(ctx, settings.MustString(settingMethod, &defMethod), u.String(), nil)
+	var body io.Reader
+	if b := settings.MustString(settingBody, &defBody); b != defBody {
+		body = strings.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, settings.MustString(settingMethod, &defMethod), u.String(), body)
 	if err != nil {
 		return fmt.Errorf("creating request: %w", err)
 	}
 	req.Header.Set("User-Agent", "ipt-loadbalancer/v1 (https://git.luzifer.io/luzifer/ipt-loadbalancer)")
 
+	for _, entry := range settings.MustStringSlice(settingHeaders, &defHeaders) {
+		key, value, err := common.SplitKeyValue(entry)
+		if err != nil {
+			return fmt.Errorf("parsing headers: %w", err)
+		}
+
+		if strings.EqualFold(key, "Host") {
+			req.Host = value
+			continue
+		}
+
+		req.Header.Add(key, value)
+	}
+
+	// The Host header is ignored by the client, the Host field of the
+	// request is what is sent
 	if hh := settings.MustString(settingHost, &defHost); hh != defHost {
-		req.Header.Set("Host", hh)
+		req.Host = hh
 	}
 
-	client := http.Client{}
-	if settings.MustBool(settingInsecureTLS, &defInsecureTLS) {
-		client.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true, //nolint:gosec // The intention is to use insecure TLS
-			},
-		}
+	transport, err := c.transport(settings, req.Host)
+	if err != nil {
+		return err
+	}
+	defer transport.CloseIdleConnections()
+
+	client := http.Client{
+		CheckRedirect: c.redirectPolicy(settings),
+		Transport:     transport,
 	}
 
 	resp, err := client.Do(req)
@@ -87,42 +142,263 @@ func (c Check) Check(settings *fieldcollection.FieldCollection, target config.Ta
 	}
 	defer resp.Body.Close() //nolint:errcheck
 
-	if resp.StatusCode != int(settings.MustInt64(settingCode, c.intToInt64Ptr(defCode))) {
-		return fmt.Errorf("unexpected status code %d != %d", resp.StatusCode, settings.MustInt64(settingCode, c.intToInt64Ptr(defCode)))
+	if err = c.checkStatus(settings, resp.StatusCode); err != nil {
+		return err
+	}
+
+	for _, entry := range settings.MustStringSlice(settingExpectHeaders, &defExpectHeaders) {
+		key, expr, err := common.SplitKeyValue(entry)
+		if err != nil {
+			return fmt.Errorf("parsing expected headers: %w", err)
+		}
+
+		match, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("parsing expected header %q expression: %w", key, err)
+		}
+
+		if !match.MatchString(resp.Header.Get(key)) {
+			return fmt.Errorf("header %q value %q does not match %q", key, resp.Header.Get(key), expr)
+		}
 	}
 
-	if settings.MustString(settingExpectContent, &defExpectContent) == defExpectContent {
+	var (
+		expectContent = settings.MustString(settingExpectContent, &defExpectContent)
+		expectJSON    = settings.MustStringSlice(settingExpectJSON, &defExpectJSON)
+		expectRegex   = settings.MustString(settingExpectRegex, &defExpectRegex)
+	)
+
+	if expectContent == defExpectContent && expectRegex == defExpectRegex && len(expectJSON) == 0 {
 		return nil
 	}
 
-	content, err := io.ReadAll(req.Body)
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
 	if err != nil {
 		return fmt.Errorf("reading response body: %w", err)
 	}
 
-	if !strings.Contains(string(content), settings.MustString(settingExpectContent, &defExpectContent)) {
+	if !strings.Contains(string(content), expectContent) {
 		return fmt.Errorf("expected content not found in body")
 	}
 
+	if expectRegex != defExpectRegex {
+		match, err := regexp.Compile(expectRegex)
+		if err != nil {
+			return fmt.Errorf("parsing expected body expression: %w", err)
+		}
+
+		if !match.Match(content) {
+			return fmt.Errorf("body does not match %q", expectRegex)
+		}
+	}
+
+	if len(expectJSON) > 0 {
+		if err = c.checkJSON(content, expectJSON); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 // Help returns the set of settings used in the check
 func (Check) Help() (help []common.SettingHelp) {
 	return []common.SettingHelp{
+		{Name: settingBody, Default: defBody, Description: "Body to send with the request"},
+		{Name: settingClientCert, Default: defClientCert, Description: "PEM file with the client certificate to present"},
+		{Name: settingClientKey, Default: defClientKey, Description: "PEM file with the key of the client certificate"},
 		{Name: settingCode, Default: defCode, Description: "HTTP Status-Code to expect from the request"},
+		{Name: settingCodes, Default: defCodes, Description: "List of HTTP Status-Codes to accept (overrides code): single codes (200), ranges (200-299) or classes (2xx)"},
 		{Name: settingExpectContent, Default: defExpectContent, Description: "Content to search in the response body"},
+		{Name: settingExpectHeaders, Default: defExpectHeaders, Description: "List of 'Header: regex' entries the response headers must match"},
+		{Name: settingExpectJSON, Default: defExpectJSON, Description: "List of 'path=value' entries the JSON response body must contain (path like '$.status' or 'checks.0.ok')"},
+		{Name: settingExpectRegex, Default: defExpectRegex, Description: "Regular expression the response body must match"},
+		{Name: settingFollowRedirects, Default: defFollowRedirects, Description: "Follow redirects (the status of the last response is checked)"},
+		{Name: settingHeaders, Default: defHeaders, Description: "List of 'Header: value' entries to send with the request"},
 		{Name: settingHost, Default: defHost, Description: "Host header to send with the request"},
 		{Name: settingInsecureTLS, Default: defInsecureTLS, Description: "Skip TLS certificate validation"},
+		{Name: settingMaxRedirects, Default: defMaxRedirects, Description: "Maximum number of redirects to follow"},
 		{Name: settingMethod, Default: defMethod, Description: "Method to use for request"},
 		{Name: settingPath, Default: defPath, Description: "Path to send the request to"},
 		{Name: settingPort, Default: "target-port", Description: "Port to send the request to"},
+		{Name: settingServerName, Default: defServerName, Description: "Server name to send through SNI (defaults to the Host header)"},
 		{Name: settingTimeout, Default: defTimeout, Description: "Timeout for the HTTP request"},
 		{Name: settingTLS, Default: defTLS, Description: "Connect to port using TLS"},
 	}
 }
 
+// checkJSON evaluates the 'path=value' assertions against the given
+// JSON document
+func (Check) checkJSON(content []byte, assertions []string) error {
+	var doc any
+	if err := json.Unmarshal(content, &doc); err != nil {
+		return fmt.Errorf("parsing JSON body: %w", err)
+	}
+
+	for _, assertion := range assertions {
+		path, expected, ok := strings.Cut(assertion, "=")
+		if !ok {
+			return fmt.Errorf("invalid JSON assertion %q, expected 'path=value'", assertion)
+		}
+
+		value, err := lookupJSONPath(doc, strings.TrimSpace(path))
+		if err != nil {
+			return fmt.Errorf("evaluating JSON path %q: %w", path, err)
+		}
+
+		if value != strings.TrimSpace(expected) {
+			return fmt.Errorf("JSON path %q has value %q, expected %q", path, value, strings.TrimSpace(expected))
+		}
+	}
+
+	return nil
+}
+
+// checkStatus validates the status code against the codes setting or
+// the code setting if no list is given
+func (c Check) checkStatus(settings *fieldcollection.FieldCollection, status int) error {
+	codes := settings.MustStringSlice(settingCodes, &defCodes)
+	if len(codes) == 0 {
+		if status != int(settings.MustInt64(settingCode, c.intToInt64Ptr(defCode))) {
+			return fmt.Errorf("unexpected status code %d != %d", status, settings.MustInt64(settingCode, c.intToInt64Ptr(defCode)))
+		}
+		return nil
+	}
+
+	for _, code := range codes {
+		lower, upper, err := parseStatusRange(code)
+		if err != nil {
+			return fmt.Errorf("parsing status codes: %w", err)
+		}
+
+		if status >= lower && status <= upper {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unexpected status code %d not in %v", status, codes)
+}
+
 func (Check) intToInt64Ptr(i int) *int64 {
 	i64 := int64(i)
 	return &i64
 }
+
+// redirectPolicy returns the CheckRedirect function of the client:
+// when not following redirects the redirect response itself is
+// evaluated
+func (Check) redirectPolicy(settings *fieldcollection.FieldCollection) func(*http.Request, []*http.Request) error {
+	if !settings.MustBool(settingFollowRedirects, &defFollowRedirects) {
+		return func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	}
+
+	maxRedirects := int(settings.MustInt64(settingMaxRedirects, &defMaxRedirects))
+	return func(_ *http.Request, via []*http.Request) error {
+		if len(via) > maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		return nil
+	}
+}
+
+// transport creates a transport for a single check using the TLS
+// settings of the check
+func (Check) transport(settings *fieldcollection.FieldCollection, host string) (*http.Transport, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: settings.MustBool(settingInsecureTLS, &defInsecureTLS), //nolint:gosec // The intention is to allow insecure TLS
+		ServerName:         settings.MustString(settingServerName, &defServerName),
+	}
+
+	if tlsConfig.ServerName == "" && host != "" {
+		// Strip the port from the host as it is not part of the SNI
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		tlsConfig.ServerName = host
+	}
+
+	certFile := settings.MustString(settingClientCert, &defClientCert)
+	keyFile := settings.MustString(settingClientKey, &defClientKey)
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	// Every check uses a fresh connection to not keep idle connections
+	// to all targets open
+	return &http.Transport{
+		DisableKeepAlives: true,
+		TLSClientConfig:   tlsConfig,
+	}, nil
+}
+
+// lookupJSONPath resolves the dot-separated path (optionally prefixed
+// with '$.') in the given document and returns the value as string:
+// strings are returned as-is, other values JSON encoded
+func lookupJSONPath(doc any, path string) (string, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+
+	current := doc
+	if path != "" {
+		for _, key := range strings.Split(path, ".") {
+			switch v := current.(type) {
+			case map[string]any:
+				next, ok := v[key]
+				if !ok {
+					return "", fmt.Errorf("key %q not found", key)
+				}
+				current = next
+
+			case []any:
+				idx, err := strconv.Atoi(key)
+				if err != nil || idx < 0 || idx >= len(v) {
+					return "", fmt.Errorf("invalid index %q", key)
+				}
+				current = v[idx]
+
+			default:
+				return "", fmt.Errorf("cannot descend into %q", key)
+			}
+		}
+	}
+
+	if s, ok := current.(string); ok {
+		return s, nil
+	}
+
+	enc, err := json.Marshal(current)
+	if err != nil {
+		return "", fmt.Errorf("encoding value: %w", err)
+	}
+
+	return string(enc), nil
+}
+
+// parseStatusRange parses a single code (200), a range (200-299) or a
+// class (2xx) into the lower and upper bound of accepted codes
+func parseStatusRange(code string) (lower, upper int, err error) {
+	code = strings.TrimSpace(code)
+
+	if m := statusClass.FindStringSubmatch(strings.ToLower(code)); m != nil {
+		class, _ := strconv.Atoi(m[1])
+		return class * 100, class*100 + 99, nil
+	}
+
+	lowerStr, upperStr, isRange := strings.Cut(code, "-")
+	if lower, err = strconv.Atoi(strings.TrimSpace(lowerStr)); err != nil {
+		return 0, 0, fmt.Errorf("invalid status code %q", code)
+	}
+
+	if !isRange {
+		return lower, lower, nil
+	}
+
+	if upper, err = strconv.Atoi(strings.TrimSpace(upperStr)); err != nil || upper < lower {
+		return 0, 0, fmt.Errorf("invalid status code range %q", code)
+	}
+
+	return lower, upper, nil
+}
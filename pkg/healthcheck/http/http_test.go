@@ -0,0 +1,164 @@
+package http
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"github.com/Luzifer/go_helpers/v2/fieldcollection"
+)
+
+func TestParseStatusRange(t *testing.T) {
+	for _, tc := range []struct {
+		code         string
+		lower, upper int
+		err          string
+	}{
+		{"200", 200, 200, ""},
+		{" 204 ", 204, 204, ""},
+		{"200-299", 200, 299, ""},
+		{"300 - 308", 300, 308, ""},
+		{"2xx", 200, 299, ""},
+		{"5XX", 500, 599, ""},
+		{"", 0, 0, "invalid status code"},
+		{"ok", 0, 0, "invalid status code"},
+		{"6xx", 0, 0, "invalid status code"},
+		{"200-", 0, 0, "invalid status code range"},
+		{"299-200", 0, 0, "invalid status code range"},
+	} {
+		lower, upper, err := parseStatusRange(tc.code)
+
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%q: unexpected error: %s", tc.code, err)
+
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%q: expected error containing %q, got %v", tc.code, tc.err, err)
+
+		case lower != tc.lower || upper != tc.upper:
+			t.Errorf("%q: expected range %d-%d, got %d-%d", tc.code, tc.lower, tc.upper, lower, upper)
+		}
+	}
+}
+
+func TestLookupJSONPath(t *testing.T) {
+	var doc any
+	if err := json.Unmarshal([]byte(`{"status":"ok","count":3,"checks":[{"name":"db","ok":true}]}`), &doc); err != nil {
+		t.Fatalf("parsing document: %s", err)
+	}
+
+	for _, tc := range []struct {
+		path, value, err string
+	}{
+		{"$.status", "ok", ""},
+		{"status", "ok", ""},
+		{"count", "3", ""},
+		{"checks.0.ok", "true", ""},
+		{"$.checks.0", `{"name":"db","ok":true}`, ""},
+		{"missing", "", `key "missing" not found`},
+		{"checks.0.missing", "", `key "missing" not found`},
+		{"checks.1", "", `invalid index "1"`},
+		{"checks.-1", "", `invalid index "-1"`},
+		{"checks.name", "", `invalid index "name"`},
+		{"status.code", "", `cannot descend into "code"`},
+	} {
+		value, err := lookupJSONPath(doc, tc.path)
+
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%q: unexpected error: %s", tc.path, err)
+
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%q: expected error containing %q, got %v", tc.path, tc.err, err)
+
+		case value != tc.value:
+			t.Errorf("%q: expected value %q, got %q", tc.path, tc.value, value)
+		}
+	}
+}
+
+func TestCheckStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		settings map[string]any
+		status   int
+		err      string
+	}{
+		{"default code", nil, http.StatusOK, ""},
+		{"default code mismatch", nil, http.StatusNoContent, "unexpected status code 204 != 200"},
+		{"code", map[string]any{settingCode: 204}, http.StatusNoContent, ""},
+		{"code mismatch", map[string]any{settingCode: 204}, http.StatusOK, "unexpected status code 200 != 204"},
+		{"codes list", map[string]any{settingCodes: []any{"200", "301-302", "4xx"}}, http.StatusFound, ""},
+		{"codes class", map[string]any{settingCodes: []any{"200", "301-302", "4xx"}}, http.StatusTeapot, ""},
+		{"codes override code", map[string]any{settingCode: 204, settingCodes: []any{"200"}}, http.StatusOK, ""},
+		{"codes mismatch", map[string]any{settingCodes: []any{"200", "301-302", "4xx"}}, http.StatusInternalServerError, "not in"},
+		{"invalid codes", map[string]any{settingCodes: []any{"20x"}}, http.StatusOK, "parsing status codes"},
+	} {
+		err := New().checkStatus(fieldcollection.FieldCollectionFromData(tc.settings), tc.status)
+
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"ok","checks":[{"ok":true}]}`)) //nolint:errcheck,gosec
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/host", func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "example.com" {
+			w.WriteHeader(http.StatusMisdirectedRequest)
+		}
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	addr := srv.Listener.Addr().(*net.TCPAddr)
+	target := config.Target{Addr: addr.IP.String(), Port: addr.Port}
+
+	for _, tc := range []struct {
+		name     string
+		settings map[string]any
+		err      string
+	}{
+		{"probe", nil, ""},
+		{"json", map[string]any{settingExpectJSON: []any{"$.status=ok", "checks.0.ok=true"}}, ""},
+		{"json mismatch", map[string]any{settingExpectJSON: []any{"$.status=failed"}}, `has value "ok"`},
+		{"content type", map[string]any{settingExpectHeaders: []any{"Content-Type: ^application/json$"}}, ""},
+		{"follow redirect", map[string]any{settingPath: "/redirect"}, ""},
+		{"not following redirect", map[string]any{settingPath: "/redirect", settingFollowRedirects: false}, "unexpected status code 302 != 200"},
+		{"expecting redirect", map[string]any{settingPath: "/redirect", settingFollowRedirects: false, settingCode: http.StatusFound}, ""},
+		{"redirect loop", map[string]any{settingPath: "/loop", settingMaxRedirects: 3}, "stopped after 3 redirects"},
+		{"host override", map[string]any{settingPath: "/host", settingHost: "example.com"}, ""},
+		{"host header", map[string]any{settingPath: "/host", settingHeaders: []any{"Host: example.com"}}, ""},
+		{"without host override", map[string]any{settingPath: "/host"}, "unexpected status code 421"},
+	} {
+		err := New().Check(fieldcollection.FieldCollectionFromData(tc.settings), target)
+
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.err, err)
+		}
+	}
+}
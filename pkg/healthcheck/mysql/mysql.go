@@ -0,0 +1,125 @@
+// Package mysql contains a health-check to verify a MySQL / MariaDB
+// server accepts logins and answers queries
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/healthcheck/common"
+	"github.com/Luzifer/go_helpers/v2/fieldcollection"
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	settingDatabase    = "database"
+	settingInsecureTLS = "insecureTLS"
+	settingPassword    = "password"
+	settingPort        = "port"
+	settingQuery       = "query"
+	settingRole        = "role"
+	settingTimeout     = "timeout"
+	settingTLS         = "tls"
+	settingUser        = "user"
+)
+
+type (
+	// Check represents the MySQL check
+	Check struct{}
+)
+
+var (
+	defDatabase    = ""
+	defInsecureTLS = false
+	defPassword    = ""
+	defQuery       = "SELECT 1"
+	defRole        = common.RoleAny
+	defTimeout     = time.Second
+	defTLS         = false
+	defUser        = "root"
+)
+
+// New returns a new MySQL check
+func New() Check { return Check{} }
+
+// Check executes the check
+func (c Check) Check(settings *fieldcollection.FieldCollection, target config.Target) error {
+	role := settings.MustString(settingRole, &defRole)
+	if err := common.ValidateRole(role); err != nil {
+		return fmt.Errorf("validating role: %w", err)
+	}
+
+	timeout := settings.MustDuration(settingTimeout, &defTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cfg := mysql.NewConfig()
+	cfg.Net = "tcp"
+	cfg.Addr = net.JoinHostPort(target.Addr, strconv.FormatInt(settings.MustInt64(settingPort, c.intToInt64Ptr(target.Port)), 10))
+	cfg.DBName = settings.MustString(settingDatabase, &defDatabase)
+	cfg.Passwd = settings.MustString(settingPassword, &defPassword)
+	cfg.Timeout = timeout
+	cfg.User = settings.MustString(settingUser, &defUser)
+
+	switch {
+	case settings.MustBool(settingTLS, &defTLS) && settings.MustBool(settingInsecureTLS, &defInsecureTLS):
+		cfg.TLSConfig = "skip-verify"
+	case settings.MustBool(settingTLS, &defTLS):
+		cfg.TLSConfig = "true"
+	}
+
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return fmt.Errorf("creating connector: %w", err)
+	}
+
+	db := sql.OpenDB(connector)
+	defer db.Close() //nolint:errcheck
+
+	// Keep the probe and the role query on the same connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("connecting: %w", err)
+	}
+	defer conn.Close() //nolint:errcheck
+
+	if _, err = conn.ExecContext(ctx, settings.MustString(settingQuery, &defQuery)); err != nil {
+		return fmt.Errorf("executing probe query: %w", err)
+	}
+
+	if role == common.RoleAny {
+		return nil
+	}
+
+	var readOnly bool
+	if err = conn.QueryRowContext(ctx, "SELECT @@global.read_only").Scan(&readOnly); err != nil {
+		return fmt.Errorf("querying read-only state: %w", err)
+	}
+
+	return common.CheckRole(role, !readOnly) //nolint:wrapcheck // Error is already descriptive
+}
+
+// Help returns the set of settings used in the check
+func (Check) Help() (help []common.SettingHelp) {
+	return []common.SettingHelp{
+		{Name: settingDatabase, Default: defDatabase, Description: "Database to connect to"},
+		{Name: settingInsecureTLS, Default: defInsecureTLS, Description: "Skip TLS certificate validation"},
+		{Name: settingPassword, Default: defPassword, Description: "Password to authenticate with"},
+		{Name: settingPort, Default: "target-port", Description: "Port to connect to"},
+		{Name: settingQuery, Default: defQuery, Description: "Probe query which must succeed"},
+		{Name: settingRole, Default: defRole, Description: "Role the server must have: primary, replica or empty for any (determined through the read_only variable)"},
+		{Name: settingTimeout, Default: defTimeout, Description: "Timeout for the connect and queries"},
+		{Name: settingTLS, Default: defTLS, Description: "Connect to the server using TLS"},
+		{Name: settingUser, Default: defUser, Description: "User to authenticate as"},
+	}
+}
+
+func (Check) intToInt64Ptr(i int) *int64 {
+	i64 := int64(i)
+	return &i64
+}
@@ -0,0 +1,206 @@
+package mysql
+
+import (
+	"bytes"
+	"crypto/sha1" //#nosec:G505 // Required by the mysql_native_password scheme
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"github.com/Luzifer/go_helpers/v2/fieldcollection"
+)
+
+// Capabilities of the fake server: long password, protocol 4.1,
+// transactions, secure connection and plugin auth
+const fakeCapabilities = 0x1 | 0x200 | 0x2000 | 0x8000 | 0x80000
+
+var scramble = []byte("0123456789abcdefghij")
+
+// nativePassword computes the mysql_native_password auth response
+func nativePassword(password string) []byte {
+	hash := func(data ...[]byte) []byte {
+		h := sha1.New() //#nosec:G401 // Required by the mysql_native_password scheme
+		for _, d := range data {
+			h.Write(d)
+		}
+		return h.Sum(nil)
+	}
+
+	stage1 := hash([]byte(password))
+	resp := hash(scramble, hash(stage1))
+	for i := range resp {
+		resp[i] ^= stage1[i]
+	}
+
+	return resp
+}
+
+// mysqlConn implements the packet framing of the fake server
+type mysqlConn struct {
+	net.Conn
+	seq byte
+}
+
+func (c *mysqlConn) read() ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	c.seq = hdr[3] + 1
+
+	payload := make([]byte, int(hdr[0])|int(hdr[1])<<8|int(hdr[2])<<16)
+	_, err := io.ReadFull(c, payload)
+	return payload, err //nolint:wrapcheck
+}
+
+func (c *mysqlConn) write(payloads ...[]byte) error {
+	for _, p := range payloads {
+		if _, err := c.Write(append([]byte{byte(len(p)), byte(len(p) >> 8), byte(len(p) >> 16), c.seq}, p...)); err != nil {
+			return err //nolint:wrapcheck
+		}
+		c.seq++
+	}
+	return nil
+}
+
+func lenencString(s string) []byte { return append([]byte{byte(len(s))}, s...) }
+
+var (
+	eofPacket = []byte{0xfe, 0, 0, 0x02, 0}
+	okPacket  = []byte{0x00, 0, 0, 0x02, 0, 0, 0}
+)
+
+func errPacket(message string) []byte {
+	return append([]byte{0xff, 0x28, 0x04, '#', '4', '2', '0', '0', '0'}, message...)
+}
+
+// serveMySQL starts a server accepting the password "secret" for the
+// user root, answering "SELECT 1" and reporting the given read-only
+// state
+func serveMySQL(t *testing.T, readOnly bool) config.Target {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+	t.Cleanup(func() { l.Close() }) //nolint:errcheck,gosec
+
+	handshake := bytes.Join([][]byte{
+		{0x0a}, []byte("8.0.0-fake\x00"), {1, 0, 0, 0},
+		scramble[:8], {0},
+		binary.LittleEndian.AppendUint16(nil, fakeCapabilities&0xffff),
+		{0x21, 0x02, 0},
+		binary.LittleEndian.AppendUint16(nil, fakeCapabilities>>16),
+		{byte(len(scramble) + 1)}, make([]byte, 10),
+		scramble[8:], {0},
+		[]byte("mysql_native_password\x00"),
+	}, nil)
+
+	handle := func(conn *mysqlConn) {
+		defer conn.Close() //nolint:errcheck
+
+		if err := conn.write(handshake); err != nil {
+			return
+		}
+
+		// Handshake response: flags, max packet size, charset, filler,
+		// user and length prefixed auth response
+		resp, err := conn.read()
+		if err != nil || len(resp) < 32 {
+			return
+		}
+		user, rest, _ := bytes.Cut(resp[32:], []byte{0})
+		if len(rest) == 0 || string(user) != "root" || !bytes.Equal(rest[1:1+int(rest[0])], nativePassword("secret")) {
+			conn.write(errPacket("Access denied for user")) //nolint:errcheck,gosec
+			return
+		}
+
+		if err = conn.write(okPacket); err != nil {
+			return
+		}
+
+		for {
+			cmd, err := conn.read()
+			if err != nil || len(cmd) == 0 || cmd[0] != 0x03 {
+				return
+			}
+
+			switch string(cmd[1:]) {
+			case "SELECT 1":
+				err = conn.write(okPacket)
+
+			case "SELECT @@global.read_only":
+				value := "0"
+				if readOnly {
+					value = "1"
+				}
+
+				err = conn.write(
+					[]byte{1},
+					bytes.Join([][]byte{
+						lenencString("def"), lenencString(""), lenencString(""), lenencString(""),
+						lenencString("@@global.read_only"), lenencString(""),
+						{0x0c, 0x3f, 0, 1, 0, 0, 0, 0x08, 0, 0, 0, 0, 0},
+					}, nil),
+					eofPacket,
+					lenencString(value),
+					eofPacket,
+				)
+
+			default:
+				err = conn.write(errPacket("You have an error in your SQL syntax"))
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(&mysqlConn{Conn: conn})
+		}
+	}()
+
+	return config.Target{Addr: "127.0.0.1", Port: l.Addr().(*net.TCPAddr).Port}
+}
+
+func TestCheck(t *testing.T) {
+	var (
+		primary = serveMySQL(t, false)
+		replica = serveMySQL(t, true)
+	)
+
+	for _, tc := range []struct {
+		name     string
+		target   config.Target
+		settings map[string]any
+		err      string
+	}{
+		{"probe", primary, map[string]any{settingPassword: "secret"}, ""},
+		{"wrong password", primary, map[string]any{settingPassword: "wrong"}, "Access denied"},
+		{"failing query", primary, map[string]any{settingPassword: "secret", settingQuery: "SELEC 1"}, "executing probe query"},
+		{"primary", primary, map[string]any{settingPassword: "secret", settingRole: "primary"}, ""},
+		{"primary as replica", primary, map[string]any{settingPassword: "secret", settingRole: "replica"}, "target is not a replica"},
+		{"replica", replica, map[string]any{settingPassword: "secret", settingRole: "replica"}, ""},
+		{"replica as primary", replica, map[string]any{settingPassword: "secret", settingRole: "primary"}, "target is not a primary"},
+		{"unknown role", primary, map[string]any{settingRole: "leader"}, "validating role"},
+	} {
+		err := New().Check(fieldcollection.FieldCollectionFromData(tc.settings), tc.target)
+
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.err, err)
+		}
+	}
+}
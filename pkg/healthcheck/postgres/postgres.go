@@ -0,0 +1,113 @@
+// Package postgres contains a health-check to verify a PostgreSQL
+// server accepts logins and answers queries
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/healthcheck/common"
+	"github.com/Luzifer/go_helpers/v2/fieldcollection"
+	_ "github.com/lib/pq" // Register the postgres driver
+)
+
+const (
+	settingDatabase = "database"
+	settingPassword = "password"
+	settingPort     = "port"
+	settingQuery    = "query"
+	settingRole     = "role"
+	settingSSLMode  = "sslMode"
+	settingTimeout  = "timeout"
+	settingUser     = "user"
+)
+
+type (
+	// Check represents the PostgreSQL check
+	Check struct{}
+)
+
+var (
+	defDatabase = "postgres"
+	defPassword = ""
+	defQuery    = "SELECT 1"
+	defRole     = common.RoleAny
+	defSSLMode  = "disable"
+	defTimeout  = time.Second
+	defUser     = "postgres"
+)
+
+// New returns a new PostgreSQL check
+func New() Check { return Check{} }
+
+// Check executes the check
+func (c Check) Check(settings *fieldcollection.FieldCollection, target config.Target) error {
+	role := settings.MustString(settingRole, &defRole)
+	if err := common.ValidateRole(role); err != nil {
+		return fmt.Errorf("validating role: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), settings.MustDuration(settingTimeout, &defTimeout))
+	defer cancel()
+
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(settings.MustString(settingUser, &defUser), settings.MustString(settingPassword, &defPassword)),
+		Host:     net.JoinHostPort(target.Addr, strconv.FormatInt(settings.MustInt64(settingPort, c.intToInt64Ptr(target.Port)), 10)),
+		Path:     "/" + settings.MustString(settingDatabase, &defDatabase),
+		RawQuery: url.Values{"sslmode": []string{settings.MustString(settingSSLMode, &defSSLMode)}}.Encode(),
+	}
+
+	db, err := sql.Open("postgres", dsn.String())
+	if err != nil {
+		return fmt.Errorf("opening connection: %w", err)
+	}
+	defer db.Close() //nolint:errcheck
+
+	// Keep the probe and the role query on the same connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("connecting: %w", err)
+	}
+	defer conn.Close() //nolint:errcheck
+
+	if _, err = conn.ExecContext(ctx, settings.MustString(settingQuery, &defQuery)); err != nil {
+		return fmt.Errorf("executing probe query: %w", err)
+	}
+
+	if role == common.RoleAny {
+		return nil
+	}
+
+	var inRecovery bool
+	if err = conn.QueryRowContext(ctx, "SELECT pg_is_in_recovery()").Scan(&inRecovery); err != nil {
+		return fmt.Errorf("querying recovery state: %w", err)
+	}
+
+	return common.CheckRole(role, !inRecovery) //nolint:wrapcheck // Error is already descriptive
+}
+
+// Help returns the set of settings used in the check
+func (Check) Help() (help []common.SettingHelp) {
+	return []common.SettingHelp{
+		{Name: settingDatabase, Default: defDatabase, Description: "Database to connect to"},
+		{Name: settingPassword, Default: defPassword, Description: "Password to authenticate with"},
+		{Name: settingPort, Default: "target-port", Description: "Port to connect to"},
+		{Name: settingQuery, Default: defQuery, Description: "Probe query which must succeed"},
+		{Name: settingRole, Default: defRole, Description: "Role the server must have: primary, replica or empty for any (determined through pg_is_in_recovery())"},
+		{Name: settingSSLMode, Default: defSSLMode, Description: "SSL mode to use for the connection (disable, require, verify-ca, verify-full)"},
+		{Name: settingTimeout, Default: defTimeout, Description: "Timeout for the connect and queries"},
+		{Name: settingUser, Default: defUser, Description: "User to authenticate as"},
+	}
+}
+
+func (Check) intToInt64Ptr(i int) *int64 {
+	i64 := int64(i)
+	return &i64
+}
@@ -0,0 +1,160 @@
+package postgres
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"github.com/Luzifer/go_helpers/v2/fieldcollection"
+)
+
+// pgMessage encodes a message of the PostgreSQL wire protocol
+func pgMessage(typ byte, payload ...[]byte) []byte {
+	var body []byte
+	for _, p := range payload {
+		body = append(body, p...)
+	}
+
+	msg := binary.BigEndian.AppendUint32([]byte{typ}, uint32(len(body)+4)) //#nosec:G115 // Test messages are short
+	return append(msg, body...)
+}
+
+func pgInt16(v int) []byte     { return binary.BigEndian.AppendUint16(nil, uint16(v)) } //#nosec:G115 // Test values are small
+func pgInt32(v int) []byte     { return binary.BigEndian.AppendUint32(nil, uint32(v)) } //#nosec:G115 // Test values are small
+func pgString(s string) []byte { return append([]byte(s), 0) }
+
+func pgError(code, message string) []byte {
+	return pgMessage('E', []byte{'S'}, pgString("ERROR"), []byte{'C'}, pgString(code), []byte{'M'}, pgString(message), []byte{0})
+}
+
+// servePostgres starts a server accepting the password "secret",
+// answering "SELECT 1" and reporting the given recovery state
+func servePostgres(t *testing.T, inRecovery bool) config.Target {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+	t.Cleanup(func() { l.Close() }) //nolint:errcheck,gosec
+
+	ready := pgMessage('Z', []byte{'I'})
+
+	handle := func(conn net.Conn) {
+		defer conn.Close() //nolint:errcheck
+
+		var (
+			r      = bufio.NewReader(conn)
+			length uint32
+		)
+
+		// Startup message without type byte
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return
+		}
+		if _, err := io.CopyN(io.Discard, r, int64(length)-4); err != nil {
+			return
+		}
+
+		// Request a cleartext password
+		if _, err := conn.Write(pgMessage('R', pgInt32(3))); err != nil {
+			return
+		}
+
+		for {
+			typ, err := r.ReadByte()
+			if err != nil {
+				return
+			}
+			if err = binary.Read(r, binary.BigEndian, &length); err != nil {
+				return
+			}
+			payload := make([]byte, length-4)
+			if _, err = io.ReadFull(r, payload); err != nil {
+				return
+			}
+			arg := strings.TrimSuffix(string(payload), "\x00")
+
+			var resp []byte
+			switch {
+			case typ == 'p' && arg == "secret":
+				resp = append(pgMessage('R', pgInt32(0)), ready...)
+
+			case typ == 'p':
+				conn.Write(pgError("28P01", "password authentication failed")) //nolint:errcheck,gosec
+				return
+
+			case typ == 'Q' && arg == "SELECT 1":
+				resp = append(pgMessage('C', pgString("SELECT 1")), ready...)
+
+			case typ == 'Q' && arg == "SELECT pg_is_in_recovery()":
+				value := "f"
+				if inRecovery {
+					value = "t"
+				}
+
+				resp = append(resp, pgMessage('T', pgInt16(1), pgString("pg_is_in_recovery"), pgInt32(0), pgInt16(0), pgInt32(16), pgInt16(1), pgInt32(-1), pgInt16(0))...)
+				resp = append(resp, pgMessage('D', pgInt16(1), pgInt32(1), []byte(value))...)
+				resp = append(resp, pgMessage('C', pgString("SELECT 1"))...)
+				resp = append(resp, ready...)
+
+			case typ == 'Q':
+				resp = append(pgError("42601", "syntax error"), ready...)
+
+			default:
+				return
+			}
+
+			if _, err = conn.Write(resp); err != nil {
+				return
+			}
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+
+	return config.Target{Addr: "127.0.0.1", Port: l.Addr().(*net.TCPAddr).Port}
+}
+
+func TestCheck(t *testing.T) {
+	var (
+		primary = servePostgres(t, false)
+		replica = servePostgres(t, true)
+	)
+
+	for _, tc := range []struct {
+		name     string
+		target   config.Target
+		settings map[string]any
+		err      string
+	}{
+		{"probe", primary, map[string]any{settingPassword: "secret"}, ""},
+		{"wrong password", primary, map[string]any{settingPassword: "wrong"}, "password authentication failed"},
+		{"failing query", primary, map[string]any{settingPassword: "secret", settingQuery: "SELEC 1"}, "executing probe query"},
+		{"primary", primary, map[string]any{settingPassword: "secret", settingRole: "primary"}, ""},
+		{"primary as replica", primary, map[string]any{settingPassword: "secret", settingRole: "replica"}, "target is not a replica"},
+		{"replica", replica, map[string]any{settingPassword: "secret", settingRole: "replica"}, ""},
+		{"replica as primary", replica, map[string]any{settingPassword: "secret", settingRole: "primary"}, "target is not a primary"},
+		{"unknown role", primary, map[string]any{settingRole: "leader"}, "validating role"},
+	} {
+		err := New().Check(fieldcollection.FieldCollectionFromData(tc.settings), tc.target)
+
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.err, err)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+// Package redis contains a health-check to verify a Redis server
+// accepts logins and answers commands
+package redis
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/healthcheck/common"
+	"github.com/Luzifer/go_helpers/v2/fieldcollection"
+)
+
+const (
+	settingCommand     = "command"
+	settingInsecureTLS = "insecureTLS"
+	settingPassword    = "password"
+	settingPort        = "port"
+	settingRole        = "role"
+	settingTimeout     = "timeout"
+	settingTLS         = "tls"
+	settingUsername    = "username"
+)
+
+type (
+	// Check represents the Redis check
+	Check struct{}
+
+	// respError is an error reply sent by the server
+	respError string
+)
+
+var (
+	defCommand     = []string{"PING"}
+	defInsecureTLS = false
+	defPassword    = ""
+	defRole        = common.RoleAny
+	defTimeout     = time.Second
+	defTLS         = false
+	defUsername    = ""
+)
+
+// New returns a new Redis check
+func New() Check { return Check{} }
+
+// Check executes the check
+func (c Check) Check(settings *fieldcollection.FieldCollection, target config.Target) error {
+	role := settings.MustString(settingRole, &defRole)
+	if err := common.ValidateRole(role); err != nil {
+		return fmt.Errorf("validating role: %w", err)
+	}
+
+	command := settings.MustStringSlice(settingCommand, &defCommand)
+	if len(command) == 0 {
+		return errors.New("no command given")
+	}
+
+	var (
+		addr    = net.JoinHostPort(target.Addr, strconv.FormatInt(settings.MustInt64(settingPort, c.intToInt64Ptr(target.Port)), 10))
+		conn    net.Conn
+		err     error
+		timeout = settings.MustDuration(settingTimeout, &defTimeout)
+		dialer  = &net.Dialer{Timeout: timeout}
+	)
+
+	if settings.MustBool(settingTLS, &defTLS) {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{
+			InsecureSkipVerify: settings.MustBool(settingInsecureTLS, &defInsecureTLS), //#nosec:G402 // The intention is to allow insecure TLS
+		})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("dialing tcp: %w", err)
+	}
+	defer conn.Close() //nolint:errcheck
+
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return fmt.Errorf("setting deadline: %w", err)
+	}
+
+	r := bufio.NewReader(conn)
+
+	if password := settings.MustString(settingPassword, &defPassword); password != "" {
+		auth := []string{"AUTH", password}
+		if username := settings.MustString(settingUsername, &defUsername); username != "" {
+			auth = []string{"AUTH", username, password}
+		}
+
+		if _, err = c.do(conn, r, auth...); err != nil {
+			return fmt.Errorf("authenticating: %w", err)
+		}
+	}
+
+	if _, err = c.do(conn, r, command...); err != nil {
+		return fmt.Errorf("executing probe command: %w", err)
+	}
+
+	if role == common.RoleAny {
+		return nil
+	}
+
+	reply, err := c.do(conn, r, "ROLE")
+	if err != nil {
+		return fmt.Errorf("querying role: %w", err)
+	}
+
+	roleReply, ok := reply.([]any)
+	if !ok || len(roleReply) == 0 {
+		return fmt.Errorf("unexpected ROLE reply %v", reply)
+	}
+
+	return common.CheckRole(role, roleReply[0] == "master") //nolint:wrapcheck // Error is already descriptive
+}
+
+// Help returns the set of settings used in the check
+func (Check) Help() (help []common.SettingHelp) {
+	return []common.SettingHelp{
+		{Name: settingCommand, Default: defCommand, Description: "Probe command and arguments which must not return an error"},
+		{Name: settingInsecureTLS, Default: defInsecureTLS, Description: "Skip TLS certificate validation"},
+		{Name: settingPassword, Default: defPassword, Description: "Password to authenticate with (empty to skip AUTH)"},
+		{Name: settingPort, Default: "target-port", Description: "Port to connect to"},
+		{Name: settingRole, Default: defRole, Description: "Role the server must have: primary, replica or empty for any (determined through the ROLE command)"},
+		{Name: settingTimeout, Default: defTimeout, Description: "Timeout for the connect and commands"},
+		{Name: settingTLS, Default: defTLS, Description: "Connect to the server using TLS"},
+		{Name: settingUsername, Default: defUsername, Description: "Username to authenticate with (ACL, requires password)"},
+	}
+}
+
+// do sends the command and reads the reply
+func (c Check) do(w io.Writer, r *bufio.Reader, args ...string) (any, error) {
+	cmd := new(strings.Builder)
+	fmt.Fprintf(cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	if _, err := io.WriteString(w, cmd.String()); err != nil {
+		return nil, fmt.Errorf("sending command: %w", err)
+	}
+
+	reply, err := c.readReply(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if rErr, ok := reply.(respError); ok {
+		return nil, rErr
+	}
+
+	return reply, nil
+}
+
+func (Check) intToInt64Ptr(i int) *int64 {
+	i64 := int64(i)
+	return &i64
+}
+
+// readReply reads one RESP reply from the reader: error replies are
+// returned as respError values, arrays as []any
+func (c Check) readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("reading reply: %w", err)
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+
+	case '-':
+		return respError(line[1:]), nil
+
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing integer: %w", err)
+		}
+		return n, nil
+
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("parsing bulk length: %w", err)
+		}
+		if length < 0 {
+			return nil, nil
+		}
+
+		// Bulk strings are terminated by CRLF
+		buf := make([]byte, length+len("\r\n"))
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, fmt.Errorf("reading bulk string: %w", err)
+		}
+		return string(buf[:length]), nil
+
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("parsing array length: %w", err)
+		}
+
+		elems := make([]any, 0, max(count, 0))
+		for i := 0; i < count; i++ {
+			elem, err := c.readReply(r)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, elem)
+		}
+		return elems, nil
+
+	default:
+		return nil, fmt.Errorf("unexpected reply type %q", line[0])
+	}
+}
+
+func (e respError) Error() string { return string(e) }
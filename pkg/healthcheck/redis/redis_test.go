@@ -0,0 +1,141 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"github.com/Luzifer/go_helpers/v2/fieldcollection"
+)
+
+// serveRedis starts a server answering PING, AUTH (accepting the
+// password "secret" with or without the user "admin") and ROLE with
+// the given role
+func serveRedis(t *testing.T, role string) config.Target {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+	t.Cleanup(func() { l.Close() }) //nolint:errcheck,gosec
+
+	handle := func(conn net.Conn) {
+		defer conn.Close() //nolint:errcheck
+
+		r := bufio.NewReader(conn)
+		for {
+			req, err := New().readReply(r)
+			if err != nil {
+				return
+			}
+
+			var args []string
+			for _, arg := range req.([]any) {
+				args = append(args, arg.(string))
+			}
+
+			var reply string
+			switch {
+			case args[0] == "PING":
+				reply = "+PONG\r\n"
+
+			case args[0] == "AUTH" && (reflect.DeepEqual(args[1:], []string{"secret"}) || reflect.DeepEqual(args[1:], []string{"admin", "secret"})):
+				reply = "+OK\r\n"
+
+			case args[0] == "AUTH":
+				reply = "-WRONGPASS invalid username-password pair\r\n"
+
+			case args[0] == "ROLE":
+				reply = fmt.Sprintf("*3\r\n$%d\r\n%s\r\n:0\r\n*0\r\n", len(role), role)
+
+			default:
+				reply = fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+			}
+
+			if _, err = conn.Write([]byte(reply)); err != nil {
+				return
+			}
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+
+	return config.Target{Addr: "127.0.0.1", Port: l.Addr().(*net.TCPAddr).Port}
+}
+
+func TestCheck(t *testing.T) {
+	var (
+		primary = serveRedis(t, "master")
+		replica = serveRedis(t, "slave")
+	)
+
+	for _, tc := range []struct {
+		name     string
+		target   config.Target
+		settings map[string]any
+		err      string
+	}{
+		{"ping", primary, map[string]any{}, ""},
+		{"password", primary, map[string]any{settingPassword: "secret"}, ""},
+		{"username and password", primary, map[string]any{settingUsername: "admin", settingPassword: "secret"}, ""},
+		{"wrong password", primary, map[string]any{settingPassword: "wrong"}, "authenticating: WRONGPASS"},
+		{"failing command", primary, map[string]any{settingCommand: []any{"INFO", "replication"}}, "executing probe command: ERR unknown command"},
+		{"no command", primary, map[string]any{settingCommand: []any{}}, "no command given"},
+		{"primary", primary, map[string]any{settingRole: "primary"}, ""},
+		{"primary as replica", primary, map[string]any{settingRole: "replica"}, "target is not a replica"},
+		{"replica", replica, map[string]any{settingRole: "replica"}, ""},
+		{"replica as primary", replica, map[string]any{settingRole: "primary"}, "target is not a primary"},
+		{"unknown role", primary, map[string]any{settingRole: "leader"}, "validating role"},
+	} {
+		err := New().Check(fieldcollection.FieldCollectionFromData(tc.settings), tc.target)
+
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	for _, tc := range []struct {
+		raw   string
+		reply any
+		err   bool
+	}{
+		{"+OK\r\n", "OK", false},
+		{"-ERR failed\r\n", respError("ERR failed"), false},
+		{":42\r\n", int64(42), false},
+		{"$5\r\nhello\r\n", "hello", false},
+		{"$-1\r\n", nil, false},
+		{"*2\r\n$6\r\nmaster\r\n*1\r\n:1\r\n", []any{"master", []any{int64(1)}}, false},
+		{"*0\r\n", []any{}, false},
+		{"?unknown\r\n", nil, true},
+		{":abc\r\n", nil, true},
+		{"$10\r\nshort\r\n", nil, true},
+		{"\r\n", nil, true},
+	} {
+		reply, err := New().readReply(bufio.NewReader(strings.NewReader(tc.raw)))
+		if (err != nil) != tc.err {
+			t.Errorf("%q: unexpected error state: %v", tc.raw, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(reply, tc.reply) {
+			t.Errorf("%q: unexpected reply %#v, expected %#v", tc.raw, reply, tc.reply)
+		}
+	}
+}
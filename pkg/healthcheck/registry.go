@@ -5,9 +5,17 @@ package healthcheck
 import (
 	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
 	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/healthcheck/common"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/healthcheck/dns"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/healthcheck/exec"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/healthcheck/grpc"
 	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/healthcheck/http"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/healthcheck/mysql"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/healthcheck/postgres"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/healthcheck/redis"
 	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/healthcheck/smtp"
 	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/healthcheck/tcp"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/healthcheck/tls"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/healthcheck/udp"
 	"github.com/Luzifer/go_helpers/v2/fieldcollection"
 )
 
@@ -23,15 +31,39 @@ type (
 // is not registered
 func ByName(name string) Checker {
 	switch name {
+	case "dns":
+		return dns.New()
+
+	case "exec":
+		return exec.New()
+
+	case "grpc":
+		return grpc.New()
+
 	case "http":
 		return http.New()
 
+	case "mysql":
+		return mysql.New()
+
+	case "postgres":
+		return postgres.New()
+
+	case "redis":
+		return redis.New()
+
 	case "smtp":
 		return smtp.New()
 
 	case "tcp":
 		return tcp.New()
 
+	case "tls":
+		return tls.New()
+
+	case "udp":
+		return udp.New()
+
 	default:
 		return nil
 	}
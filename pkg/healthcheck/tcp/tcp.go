@@ -4,6 +4,7 @@ package tcp
 import (
 	"fmt"
 	"net"
+	"strconv"
 	"time"
 
 	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
@@ -30,7 +31,7 @@ func New() Check { return Check{} }
 func (c Check) Check(settings *fieldcollection.FieldCollection, target config.Target) error {
 	conn, err := net.DialTimeout(
 		"tcp",
-		fmt.Sprintf("%s:%d", target.Addr, settings.MustInt64(settingPort, c.intToInt64Ptr(target.Port))),
+		net.JoinHostPort(target.Addr, strconv.FormatInt(settings.MustInt64(settingPort, c.intToInt64Ptr(target.Port)), 10)),
 		settings.MustDuration(settingTimeout, &defTimeout),
 	)
 	if err != nil {
@@ -0,0 +1,181 @@
+// Package tls contains a health-check to verify the target completes
+// a TLS handshake presenting a valid certificate
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/healthcheck/common"
+	"github.com/Luzifer/go_helpers/v2/fieldcollection"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	settingALPN         = "alpn"
+	settingCAFile       = "caFile"
+	settingExpiryAction = "expiryAction"
+	settingHostname     = "hostname"
+	settingInsecureTLS  = "insecureTLS"
+	settingMinValidity  = "minValidity"
+	settingPort         = "port"
+	settingServerName   = "serverName"
+	settingTimeout      = "timeout"
+)
+
+// Actions to take when the certificate expires within minValidity
+const (
+	expiryActionFail = "fail"
+	expiryActionWarn = "warn"
+)
+
+type (
+	// Check represents the TLS check
+	Check struct{}
+)
+
+var (
+	defALPN         = []string{}
+	defCAFile       = ""
+	defExpiryAction = expiryActionFail
+	defHostname     = ""
+	defInsecureTLS  = false
+	defMinValidity  = time.Duration(0)
+	defServerName   = ""
+	defTimeout      = time.Second
+)
+
+// New returns a new TLS check
+func New() Check { return Check{} }
+
+// Check executes the check
+func (c Check) Check(settings *fieldcollection.FieldCollection, target config.Target) error {
+	expiryAction := settings.MustString(settingExpiryAction, &defExpiryAction)
+	if expiryAction != expiryActionFail && expiryAction != expiryActionWarn {
+		return fmt.Errorf("unknown expiry action %q", expiryAction)
+	}
+
+	roots, err := c.loadRoots(settings.MustString(settingCAFile, &defCAFile))
+	if err != nil {
+		return err
+	}
+
+	alpn := settings.MustStringSlice(settingALPN, &defALPN)
+	serverName := settings.MustString(settingServerName, &defServerName)
+
+	// Verification is done after the handshake to be able to verify
+	// against a hostname differing from the SNI and to report all
+	// problems of the certificate
+	conn, err := tls.DialWithDialer(
+		&net.Dialer{Timeout: settings.MustDuration(settingTimeout, &defTimeout)},
+		"tcp",
+		net.JoinHostPort(target.Addr, strconv.FormatInt(settings.MustInt64(settingPort, c.intToInt64Ptr(target.Port)), 10)),
+		&tls.Config{
+			InsecureSkipVerify: true, //#nosec:G402 // Certificate is verified below
+			NextProtos:         alpn,
+			ServerName:         serverName,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("executing handshake: %w", err)
+	}
+	defer conn.Close() //nolint:errcheck
+
+	state := conn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("no certificate presented")
+	}
+
+	if len(alpn) > 0 && !slices.Contains(alpn, state.NegotiatedProtocol) {
+		return fmt.Errorf("unexpected negotiated protocol %q", state.NegotiatedProtocol)
+	}
+
+	leaf := state.PeerCertificates[0]
+
+	if !settings.MustBool(settingInsecureTLS, &defInsecureTLS) {
+		hostname := settings.MustString(settingHostname, &defHostname)
+		switch {
+		case hostname != "":
+		case serverName != "":
+			hostname = serverName
+		default:
+			hostname = target.Addr
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range state.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		if _, err = leaf.Verify(x509.VerifyOptions{
+			DNSName:       hostname,
+			Intermediates: intermediates,
+			Roots:         roots,
+		}); err != nil {
+			return fmt.Errorf("verifying certificate: %w", err)
+		}
+	}
+
+	if remaining := time.Until(leaf.NotAfter); remaining < settings.MustDuration(settingMinValidity, &defMinValidity) {
+		if expiryAction == expiryActionWarn {
+			logrus.WithFields(logrus.Fields{
+				"expires": leaf.NotAfter,
+				"subject": leaf.Subject.String(),
+				"target":  target.String(),
+			}).Warn("certificate is about to expire")
+			return nil
+		}
+
+		return fmt.Errorf("certificate expires in %s (%s)", remaining.Round(time.Second), leaf.NotAfter)
+	}
+
+	return nil
+}
+
+// Help returns the set of settings used in the check
+func (Check) Help() (help []common.SettingHelp) {
+	return []common.SettingHelp{
+		{Name: settingALPN, Default: defALPN, Description: "Protocols to offer through ALPN, one of them must be negotiated"},
+		{Name: settingCAFile, Default: defCAFile, Description: "PEM file with the CA certificates to verify against (empty for system roots)"},
+		{Name: settingExpiryAction, Default: defExpiryAction, Description: "What to do when the certificate expires within minValidity: fail or warn"},
+		{Name: settingHostname, Default: defHostname, Description: "Name the certificate must be valid for (defaults to serverName or target address)"},
+		{Name: settingInsecureTLS, Default: defInsecureTLS, Description: "Skip TLS certificate validation (validity period is still checked)"},
+		{Name: settingMinValidity, Default: defMinValidity, Description: "Minimum remaining validity of the certificate"},
+		{Name: settingPort, Default: "target-port", Description: "Port to connect to"},
+		{Name: settingServerName, Default: defServerName, Description: "Server name to send through SNI"},
+		{Name: settingTimeout, Default: defTimeout, Description: "Timeout for the connect and handshake"},
+	}
+}
+
+func (Check) intToInt64Ptr(i int) *int64 {
+	i64 := int64(i)
+	return &i64
+}
+
+// loadRoots reads the CA certificates from the given file or returns
+// nil to use the system roots if no file is given
+func (Check) loadRoots(caFile string) (*x509.CertPool, error) {
+	if caFile == "" {
+		return nil, nil
+	}
+
+	pem, err := os.ReadFile(caFile) //#nosec:G304 // This is intended to load a custom CA file
+	if err != nil {
+		return nil, fmt.Errorf("reading CA file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file %q", caFile)
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,141 @@
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"github.com/Luzifer/go_helpers/v2/fieldcollection"
+)
+
+// testCertificates creates a CA and a leaf certificate signed by it
+// valid for example.com and 127.0.0.1 for the given duration
+func testCertificates(t *testing.T, validity time.Duration) (caPEM []byte, leaf tls.Certificate) {
+	t.Helper()
+
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("generating key: %s", err)
+		}
+		return key
+	}
+
+	var (
+		caKey   = newKey()
+		leafKey = newKey()
+		now     = time.Now()
+	)
+
+	caTpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	caDER, err := x509.CreateCertificate(rand.Reader, caTpl, caTpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("creating CA certificate: %s", err)
+	}
+
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, caTpl, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("creating leaf certificate: %s", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		tls.Certificate{Certificate: [][]byte{leafDER}, PrivateKey: leafKey}
+}
+
+func TestCheck(t *testing.T) {
+	caPEM, leaf := testCertificates(t, 48*time.Hour)
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatalf("writing CA file: %s", err)
+	}
+	invalidCAFile := filepath.Join(dir, "invalid.pem")
+	if err := os.WriteFile(invalidCAFile, []byte("no certificate"), 0o600); err != nil {
+		t.Fatalf("writing CA file: %s", err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{leaf},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2"},
+	})
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+	defer l.Close() //nolint:errcheck
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake() //nolint:errcheck,gosec
+			conn.Close()                 //nolint:errcheck,gosec
+		}
+	}()
+
+	target := config.Target{Addr: "127.0.0.1", Port: l.Addr().(*net.TCPAddr).Port}
+
+	for _, tc := range []struct {
+		name     string
+		settings map[string]any
+		err      string
+	}{
+		{"valid for target address", map[string]any{settingCAFile: caFile}, ""},
+		{"valid for hostname", map[string]any{settingCAFile: caFile, settingHostname: "example.com"}, ""},
+		{"valid for server name", map[string]any{settingCAFile: caFile, settingServerName: "example.com"}, ""},
+		{"invalid hostname", map[string]any{settingCAFile: caFile, settingHostname: "other.example.com"}, "verifying certificate"},
+		{"unknown authority", map[string]any{}, "verifying certificate"},
+		{"insecure", map[string]any{settingInsecureTLS: true}, ""},
+		{"enough validity", map[string]any{settingCAFile: caFile, settingMinValidity: "24h"}, ""},
+		{"expiring", map[string]any{settingCAFile: caFile, settingMinValidity: "72h"}, "certificate expires in"},
+		{"expiring with warning", map[string]any{settingCAFile: caFile, settingMinValidity: "72h", settingExpiryAction: expiryActionWarn}, ""},
+		{"negotiated protocol", map[string]any{settingCAFile: caFile, settingALPN: []any{"h2", "http/1.1"}}, ""},
+		{"protocol not negotiated", map[string]any{settingCAFile: caFile, settingALPN: []any{"http/1.1"}}, "unexpected negotiated protocol"},
+		{"unknown expiry action", map[string]any{settingExpiryAction: "ignore"}, "unknown expiry action"},
+		{"missing CA file", map[string]any{settingCAFile: filepath.Join(dir, "missing.pem")}, "reading CA file"},
+		{"invalid CA file", map[string]any{settingCAFile: invalidCAFile}, "no certificates found"},
+	} {
+		err := New().Check(fieldcollection.FieldCollectionFromData(tc.settings), target)
+
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.err, err)
+		}
+	}
+}
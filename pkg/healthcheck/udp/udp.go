@@ -0,0 +1,122 @@
+// Package udp implements a generic UDP health-check sending a payload
+// and expecting a response
+package udp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/healthcheck/common"
+	"github.com/Luzifer/go_helpers/v2/fieldcollection"
+)
+
+const (
+	settingExpect     = "expect"
+	settingExpectHex  = "expectHex"
+	settingPayload    = "payload"
+	settingPayloadHex = "payloadHex"
+	settingPort       = "port"
+	settingTimeout    = "timeout"
+)
+
+const maxResponseSize = 65535
+
+type (
+	// Check represents the UDP check
+	Check struct{}
+)
+
+var (
+	defExpect     = ""
+	defExpectHex  = ""
+	defPayload    = ""
+	defPayloadHex = ""
+	defTimeout    = time.Second
+)
+
+// New returns a new UDP check
+func New() Check { return Check{} }
+
+// Check executes the check
+func (c Check) Check(settings *fieldcollection.FieldCollection, target config.Target) error {
+	payload := []byte(settings.MustString(settingPayload, &defPayload))
+	if ph := settings.MustString(settingPayloadHex, &defPayloadHex); ph != defPayloadHex {
+		var err error
+		if payload, err = hex.DecodeString(ph); err != nil {
+			return fmt.Errorf("decoding hex payload: %w", err)
+		}
+	}
+
+	var expect *regexp.Regexp
+	if expr := settings.MustString(settingExpect, &defExpect); expr != defExpect {
+		var err error
+		if expect, err = regexp.Compile(expr); err != nil {
+			return fmt.Errorf("parsing expect expression: %w", err)
+		}
+	}
+
+	expectBytes, err := hex.DecodeString(settings.MustString(settingExpectHex, &defExpectHex))
+	if err != nil {
+		return fmt.Errorf("decoding hex expectation: %w", err)
+	}
+
+	timeout := settings.MustDuration(settingTimeout, &defTimeout)
+	conn, err := net.DialTimeout(
+		"udp",
+		net.JoinHostPort(target.Addr, strconv.FormatInt(settings.MustInt64(settingPort, c.intToInt64Ptr(target.Port)), 10)),
+		timeout,
+	)
+	if err != nil {
+		return fmt.Errorf("dialing udp: %w", err)
+	}
+	defer conn.Close() //nolint:errcheck
+
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return fmt.Errorf("setting deadline: %w", err)
+	}
+
+	if _, err = conn.Write(payload); err != nil {
+		return fmt.Errorf("sending payload: %w", err)
+	}
+
+	// As UDP is connectionless the only way to know the target is
+	// alive is to get a response to the payload
+	buf := make([]byte, maxResponseSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return fmt.Errorf("reading response: %w", err)
+	}
+
+	if expect != nil && !expect.Match(buf[:n]) {
+		return fmt.Errorf("response does not match %q", expect.String())
+	}
+
+	if !bytes.Contains(buf[:n], expectBytes) {
+		return fmt.Errorf("response does not contain expected bytes")
+	}
+
+	return nil
+}
+
+// Help returns the set of settings used in the check
+func (Check) Help() (help []common.SettingHelp) {
+	return []common.SettingHelp{
+		{Name: settingExpect, Default: defExpect, Description: "Regular expression the response must match (empty to accept any response)"},
+		{Name: settingExpectHex, Default: defExpectHex, Description: "Hex-encoded bytes the response must contain (for binary protocols)"},
+		{Name: settingPayload, Default: defPayload, Description: "Payload to send to the target"},
+		{Name: settingPayloadHex, Default: defPayloadHex, Description: "Hex-encoded payload to send to the target (overrides payload)"},
+		{Name: settingPort, Default: "target-port", Description: "Port to send the payload to"},
+		{Name: settingTimeout, Default: defTimeout, Description: "Timeout to wait for the response"},
+	}
+}
+
+func (Check) intToInt64Ptr(i int) *int64 {
+	i64 := int64(i)
+	return &i64
+}
@@ -0,0 +1,74 @@
+package udp
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"github.com/Luzifer/go_helpers/v2/fieldcollection"
+)
+
+func TestCheck(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+	defer conn.Close() //nolint:errcheck
+
+	// Answer every payload with the payload prefixed by PONG
+	go func() {
+		buf := make([]byte, maxResponseSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(append([]byte("PONG "), buf[:n]...), addr) //nolint:errcheck,gosec
+		}
+	}()
+
+	target := config.Target{Addr: "127.0.0.1", Port: conn.LocalAddr().(*net.UDPAddr).Port}
+
+	for _, tc := range []struct {
+		name     string
+		settings map[string]any
+		err      string
+	}{
+		{"any response", map[string]any{settingPayload: "PING"}, ""},
+		{"expected response", map[string]any{settingPayload: "PING", settingExpect: "^PONG PING$"}, ""},
+		{"hex payload and expectation", map[string]any{settingPayloadHex: "00ff", settingExpectHex: "2000ff"}, ""},
+		{"unexpected response", map[string]any{settingPayload: "PING", settingExpect: "^PONG PONG$"}, "does not match"},
+		{"missing bytes", map[string]any{settingPayload: "PING", settingExpectHex: "00"}, "does not contain expected bytes"},
+		{"invalid hex payload", map[string]any{settingPayloadHex: "zz"}, "decoding hex payload"},
+		{"invalid hex expectation", map[string]any{settingPayload: "PING", settingExpectHex: "zz"}, "decoding hex expectation"},
+		{"invalid expression", map[string]any{settingExpect: "("}, "parsing expect expression"},
+	} {
+		err := New().Check(fieldcollection.FieldCollectionFromData(tc.settings), target)
+
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestCheckNoResponse(t *testing.T) {
+	// A socket never answering to the payload
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+	defer conn.Close() //nolint:errcheck
+
+	err = New().Check(fieldcollection.FieldCollectionFromData(map[string]any{
+		settingPayload: "PING",
+		settingTimeout: "100ms",
+	}), config.Target{Addr: "127.0.0.1", Port: conn.LocalAddr().(*net.UDPAddr).Port})
+	if err == nil || !strings.Contains(err.Error(), "reading response") {
+		t.Errorf("expected read error for target not answering, got %v", err)
+	}
+}
@@ -0,0 +1,236 @@
+// Package metrics contains the Prometheus metrics exposed about the
+// health of the targets and the rule rebuilds
+package metrics
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "iptlb"
+
+type (
+	instrumentedBackend struct {
+		backend.Backend
+	}
+)
+
+var (
+	checkDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "check_duration_seconds",
+		Help:      "Duration of the health-checks by checker type",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14), //nolint:mnd // 1ms to ~8s
+	}, []string{"checker"})
+
+	checkFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "check_failures_total",
+		Help:      "Number of failed health-checks by error class",
+	}, []string{"service", "target", "checker", "class"})
+
+	passiveFlows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "passive_flows_total",
+		Help:      "Number of flows to the target seen by the passive health-check by outcome",
+	}, []string{"service", "target", "outcome"})
+
+	rebuildDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "chain_rebuild_duration_seconds",
+		Help:      "Duration of the rebuilds of the managed chains",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	rebuildErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "chain_rebuild_errors_total",
+		Help:      "Number of failed rebuilds of the managed chains",
+	})
+
+	rebuilds = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "chain_rebuilds_total",
+		Help:      "Number of rebuilds of the managed chains",
+	})
+
+	servicePanic = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_panic",
+		Help:      "Whether the service is in panic mode (1) or not (0) as too few targets are healthy",
+	}, []string{"service"})
+
+	targetProbability = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "target_dnat_probability",
+		Help:      "Effective probability of new connections to the service being sent to the target",
+	}, []string{"service", "target", "family"})
+
+	targetUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "target_up",
+		Help:      "Whether the last health-check of the target succeeded (1) or not (0)",
+	}, []string{"service", "target"})
+)
+
+// ErrorClass maps the given error of a health-check to a small set
+// of classes to be used as metric label
+func ErrorClass(err error) string {
+	var (
+		dnsErr  *net.DNSError
+		netErr  net.Error
+		recErr  tls.RecordHeaderError
+		certErr *tls.CertificateVerificationError
+	)
+
+	switch {
+	case err == nil:
+		return ""
+
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return "timeout"
+
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "reset"
+
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "unreachable"
+
+	case errors.As(err, &dnsErr):
+		return "dns"
+
+	case errors.As(err, &recErr), errors.As(err, &certErr):
+		return "tls"
+
+	default:
+		return "check"
+	}
+}
+
+// InstrumentBackend wraps the given backend to record the rebuilds
+// of the managed chains and the resulting DNAT probabilities
+func InstrumentBackend(be backend.Backend) backend.Backend {
+	return instrumentedBackend{Backend: be}
+}
+
+// ObserveCheck records the result of a single health-check of the
+// given target
+func ObserveCheck(service, target, checker string, duration time.Duration, err error) {
+	checkDuration.WithLabelValues(checker).Observe(duration.Seconds())
+
+	if err != nil {
+		checkFailures.WithLabelValues(service, target, checker, ErrorClass(err)).Inc()
+	}
+}
+
+// SetServicePanic records whether the given service is in panic mode
+func SetServicePanic(service string, panicking bool) {
+	if !panicking {
+		servicePanic.WithLabelValues(service).Set(0)
+		return
+	}
+
+	servicePanic.WithLabelValues(service).Set(1)
+}
+
+// SetTargetUp records the combined result of the health-checks of
+// the given target
+func SetTargetUp(service, target string, up bool) {
+	if !up {
+		targetUp.WithLabelValues(service, target).Set(0)
+		return
+	}
+
+	targetUp.WithLabelValues(service, target).Set(1)
+}
+
+// ObservePassiveFlow records the outcome of a flow to the given
+// target seen by the passive health-check
+func ObservePassiveFlow(service, target, outcome string) {
+	passiveFlows.WithLabelValues(service, target, outcome).Inc()
+}
+
+// RemoveService removes all per-target metrics of the given service
+func RemoveService(service string) {
+	for _, vec := range []interface {
+		DeletePartialMatch(prometheus.Labels) int
+	}{checkFailures, passiveFlows, servicePanic, targetProbability, targetUp} {
+		vec.DeletePartialMatch(prometheus.Labels{"service": service})
+	}
+}
+
+// RemoveTarget removes the health metrics of the given target of a
+// service (the probabilities are rebuilt with the chains)
+func RemoveTarget(service, target string) {
+	for _, vec := range []interface {
+		DeletePartialMatch(prometheus.Labels) int
+	}{checkFailures, passiveFlows, targetUp} {
+		vec.DeletePartialMatch(prometheus.Labels{"service": service, "target": target})
+	}
+}
+
+func (i instrumentedBackend) EnsureManagedChains() error {
+	start := time.Now()
+	err := i.Backend.EnsureManagedChains()
+
+	rebuilds.Inc()
+	rebuildDuration.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		rebuildErrors.Inc()
+		return err //nolint:wrapcheck // Transparent wrapper
+	}
+
+	i.updateProbabilities()
+	return nil
+}
+
+func (i instrumentedBackend) RemoveService(service string) bool {
+	RemoveService(service)
+	return i.Backend.RemoveService(service)
+}
+
+func (i instrumentedBackend) updateProbabilities() {
+	targetProbability.Reset()
+
+	for _, s := range i.ServiceNames() {
+		// Connections are distributed within each address family
+		// among the targets of the active priority tier
+		for _, family := range common.Families {
+			var (
+				active  = make(map[common.NATTarget]bool)
+				sum     float64
+				targets = common.FilterFamily(i.ServiceTargets(s), family)
+			)
+
+			for _, t := range common.ActiveTier(targets) {
+				active[t] = true
+				sum += t.Weight
+			}
+
+			for _, t := range targets {
+				p := 0.0
+				if active[t] && sum > 0 {
+					p = t.Weight / sum
+				}
+				targetProbability.WithLabelValues(s, t.String(), family).Set(p)
+			}
+		}
+	}
+}
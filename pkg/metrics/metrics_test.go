@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRemoveTarget(t *testing.T) {
+	for _, target := range []string{"10.1.0.1:80", "10.1.0.2:80"} {
+		SetTargetUp("web", target, false)
+		ObserveCheck("web", target, "tcp", time.Millisecond, errors.New("check failed"))
+		ObservePassiveFlow("web", target, "reset")
+	}
+	SetTargetUp("api", "10.1.0.1:80", true)
+
+	RemoveTarget("web", "10.1.0.1:80")
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %s", err)
+	}
+
+	series := make(map[string]int)
+	for _, mf := range families {
+		series[mf.GetName()] = len(mf.GetMetric())
+	}
+
+	for name, expected := range map[string]int{
+		// The target of the other service must not be touched
+		"iptlb_target_up":            2,
+		"iptlb_check_failures_total": 1,
+		"iptlb_passive_flows_total":  1,
+	} {
+		if series[name] != expected {
+			t.Errorf("%s: expected %d series, got %d", name, expected, series[name])
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package servicemonitor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Administrative states of a target set by the operator
+const (
+	AdminStateEnabled  = "enabled"
+	AdminStateDisabled = "disabled"
+	AdminStateDrained  = "drained"
+)
+
+// ErrUnknownState is returned when setting a state which is not one
+// of the administrative states
+var ErrUnknownState = errors.New("unknown state")
+
+const (
+	stateDirMode  = 0o700
+	stateFileMode = 0o600
+)
+
+type (
+	// AdminStateStore keeps the administrative states set by the
+	// operator for the targets and persists them into a file so they
+	// survive a restart
+	AdminStateStore struct {
+		file string
+
+		lock   sync.RWMutex
+		states map[string]map[string]string
+	}
+)
+
+// NewAdminStateStore creates a store persisting into the given file
+// and loads the states from it if it exists. When the file name is
+// empty the states are only kept in memory.
+func NewAdminStateStore(file string) (*AdminStateStore, error) {
+	s := &AdminStateStore{
+		file:   file,
+		states: make(map[string]map[string]string),
+	}
+
+	if file == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(file) //#nosec:G304 // This is intended to load a custom state file
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return s, nil
+
+	case err != nil:
+		return nil, fmt.Errorf("reading state file: %w", err)
+	}
+
+	if err = json.Unmarshal(data, &s.states); err != nil {
+		return nil, fmt.Errorf("parsing state file: %w", err)
+	}
+
+	return s, nil
+}
+
+// Get returns the administrative state of the given target
+func (s *AdminStateStore) Get(service, target string) string {
+	if s == nil {
+		return AdminStateEnabled
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if state, ok := s.states[service][target]; ok {
+		return state
+	}
+
+	return AdminStateEnabled
+}
+
+// Set stores the administrative state of the given target and
+// persists the states to disk
+func (s *AdminStateStore) Set(service, target, state string) error {
+	if err := ValidateAdminState(state); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if state == AdminStateEnabled {
+		delete(s.states[service], target)
+		if len(s.states[service]) == 0 {
+			delete(s.states, service)
+		}
+	} else {
+		if s.states[service] == nil {
+			s.states[service] = make(map[string]string)
+		}
+		s.states[service][target] = state
+	}
+
+	return s.persist()
+}
+
+func (s *AdminStateStore) persist() error {
+	if s.file == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.states, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding states: %w", err)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(s.file), stateDirMode); err != nil {
+		return fmt.Errorf("creating state directory: %w", err)
+	}
+
+	// Write to a temporary file and rename it to not end up with a
+	// partially written state file
+	tmp := filepath.Join(filepath.Dir(s.file), "."+filepath.Base(s.file)+".tmp")
+	if err = os.WriteFile(tmp, data, stateFileMode); err != nil {
+		return fmt.Errorf("writing state file: %w", err)
+	}
+
+	if err = os.Rename(tmp, s.file); err != nil {
+		return fmt.Errorf("replacing state file: %w", err)
+	}
+
+	return nil
+}
+
+// ValidateAdminState returns an ErrUnknownState if the given state is
+// not one of the administrative states
+func ValidateAdminState(state string) error {
+	switch state {
+	case AdminStateDisabled, AdminStateDrained, AdminStateEnabled:
+		return nil
+	default:
+		return fmt.Errorf("%w %q", ErrUnknownState, state)
+	}
+}
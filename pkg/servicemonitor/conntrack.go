@@ -0,0 +1,146 @@
+package servicemonitor
+
+import (
+	"sync"
+	"time"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/common"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/conntrack"
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	// flowPolicy applies the conntrack policies of the services to
+	// the established flows of their removed targets. It is shared by
+	// all monitors of a Manager so pending expiries survive the restart
+	// of a monitor and are applied to removed services.
+	flowPolicy struct {
+		be      backend.Backend
+		flusher conntrack.Flusher
+		logger  *logrus.Entry
+
+		lock   sync.Mutex
+		expiry map[flowKey]*time.Timer
+	}
+
+	flowKey struct {
+		service string
+		target  common.NATTarget
+	}
+)
+
+func newFlowPolicy(be backend.Backend, flusher conntrack.Flusher, logger *logrus.Entry) *flowPolicy {
+	return &flowPolicy{
+		be:      be,
+		flusher: flusher,
+		logger:  logger,
+		expiry:  make(map[flowKey]*time.Timer),
+	}
+}
+
+// cancel stops a pending expiry of the flows of the given target as
+// it went back into rotation
+func (f *flowPolicy) cancel(service string, t common.NATTarget) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	key := f.key(service, t)
+	if timer, ok := f.expiry[key]; ok {
+		timer.Stop()
+		delete(f.expiry, key)
+	}
+}
+
+// handleRemoved applies the given conntrack policy to the flows of
+// the targets having been removed from the rotation of the service
+func (f *flowPolicy) handleRemoved(service string, policy config.ServiceConntrack, targets []common.NATTarget) {
+	switch policy.Policy {
+	case config.ConntrackPolicyFlush:
+		for _, t := range targets {
+			f.flush(service, t)
+		}
+
+	case config.ConntrackPolicyExpire:
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		for _, t := range targets {
+			key := f.key(service, t)
+			if timer, ok := f.expiry[key]; ok {
+				timer.Stop()
+			}
+
+			f.expiry[key] = time.AfterFunc(policy.GracePeriod, func() {
+				f.lock.Lock()
+				delete(f.expiry, key)
+				f.lock.Unlock()
+
+				if f.registered(service, t) {
+					return
+				}
+
+				f.flush(service, t)
+			})
+		}
+	}
+}
+
+// stop stops all pending expiries of flows
+func (f *flowPolicy) stop() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for key, timer := range f.expiry {
+		timer.Stop()
+		delete(f.expiry, key)
+	}
+}
+
+func (f *flowPolicy) flush(service string, t common.NATTarget) {
+	if f.flusher == nil {
+		return
+	}
+
+	logger := f.logger.WithFields(logrus.Fields{"service": service, "target": t.String()})
+	if err := f.flusher.FlushTarget(t); err != nil {
+		logger.WithError(err).Error("flushing connection tracking entries")
+		return
+	}
+
+	logger.Info("flushed connection tracking entries")
+}
+
+// key identifies the flows of the target by the attributes used to
+// flush them so the expiry is shared by all definitions of the target
+// routing the same flows (for example before and after its weight
+// was changed)
+func (*flowPolicy) key(service string, t common.NATTarget) flowKey {
+	return flowKey{service: service, target: sameFlows(t)}
+}
+
+// registered reports whether a target routing the same flows as the
+// given one is registered for the service
+func (f *flowPolicy) registered(service string, t common.NATTarget) bool {
+	for _, rt := range f.be.ServiceTargets(service) {
+		if sameFlows(rt) == sameFlows(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sameFlows reduces the target to the attributes identifying the
+// flows DNATed to it
+func sameFlows(t common.NATTarget) common.NATTarget {
+	return common.NATTarget{
+		Addr:     t.Addr,
+		BindAddr: t.BindAddr,
+		BindPort: t.BindPort,
+		Family:   t.Family,
+		Port:     t.Port,
+		Proto:    t.Proto,
+	}
+}
@@ -0,0 +1,362 @@
+package servicemonitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/common"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/conntrack"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/healthcheck"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// Errors returned by the Manager when addressing unknown entities,
+// applying services it cannot monitor or setting target states
+// without a state store
+var (
+	ErrInvalidService  = errors.New("invalid service")
+	ErrNoStateStore    = errors.New("no target state store configured")
+	ErrServiceNotFound = errors.New("service not found")
+	ErrTargetNotFound  = errors.New("target not found")
+)
+
+type (
+	// Manager keeps track of the monitors running for the configured
+	// services and starts / stops / restarts them when the service
+	// configuration changes
+	Manager struct {
+		be        backend.Backend
+		conntrack conntrack.Table
+		errs      chan error
+		flows     *flowPolicy
+		logger    *logrus.Entry
+		states    *AdminStateStore
+
+		lock     sync.Mutex
+		monitors map[string]*runningMonitor
+	}
+
+	runningMonitor struct {
+		cancel  context.CancelFunc
+		done    chan struct{}
+		monitor *Monitor
+		svc     config.Service
+	}
+
+	removedTargets struct {
+		service string
+		policy  config.ServiceConntrack
+		targets []common.NATTarget
+	}
+)
+
+// NewManager creates a new Manager without any running monitors
+func NewManager(be backend.Backend, states *AdminStateStore, ct conntrack.Table, logger *logrus.Entry) *Manager {
+	return &Manager{
+		be:        be,
+		conntrack: ct,
+		errs:      make(chan error, 1),
+		flows:     newFlowPolicy(be, ct, logger),
+		logger:    logger,
+		states:    states,
+		monitors:  make(map[string]*runningMonitor),
+	}
+}
+
+// Apply reconciles the running monitors with the given services:
+// monitors of removed services are stopped and their chains removed,
+// monitors of changed services are restarted and monitors for new
+// services are started. Unchanged services are not touched. All
+// services are validated first: if any of them is invalid an error
+// is returned and the running monitors are kept. The conntrack policy
+// of the services is applied to the targets removed from them.
+func (m *Manager) Apply(services []config.Service) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var (
+		changed  bool
+		checkers = make(map[string]*healthcheck.Composite)
+		removed  []removedTargets
+		wanted   = make(map[string]config.Service)
+	)
+
+	for _, s := range services {
+		if checkers[s.Name], err = m.validateService(s); err != nil {
+			return fmt.Errorf("%w %q: %w", ErrInvalidService, s.Name, err)
+		}
+
+		wanted[s.Name] = s
+	}
+
+	for name, rm := range m.monitors {
+		svc, ok := wanted[name]
+		if ok && reflect.DeepEqual(svc, rm.svc) {
+			continue
+		}
+
+		rm.stop()
+		delete(m.monitors, name)
+
+		if !ok {
+			m.logger.WithField("service", name).Info("removing service")
+			targets := m.be.ServiceTargets(name)
+			if m.be.RemoveService(name) {
+				changed = true
+				removed = append(removed, removedTargets{name, rm.svc.Conntrack, targets})
+			}
+			continue
+		}
+
+		m.logger.WithField("service", name).Info("restarting service")
+		svcChanged, targets := m.unregisterStaleTargets(rm.svc, svc)
+		changed = svcChanged || changed
+		removed = append(removed, removedTargets{name, svc.Conntrack, targets})
+	}
+
+	for _, s := range services {
+		if _, ok := m.monitors[s.Name]; ok {
+			continue
+		}
+
+		m.start(s, checkers[s.Name])
+	}
+
+	if !changed {
+		return nil
+	}
+
+	if err = m.be.EnsureManagedChains(); err != nil {
+		return fmt.Errorf("updating chains: %w", err)
+	}
+
+	for _, r := range removed {
+		m.flows.handleRemoved(r.service, r.policy, r.targets)
+	}
+
+	return nil
+}
+
+// Errors returns the channel errors of the monitors are sent to
+func (m *Manager) Errors() <-chan error { return m.errs }
+
+// ServiceStatus returns the status of the service with the given name
+// and whether that service is known to the manager
+func (m *Manager) ServiceStatus(name string) (ServiceStatus, bool) {
+	m.lock.Lock()
+	rm, ok := m.monitors[name]
+	m.lock.Unlock()
+
+	if !ok {
+		return ServiceStatus{}, false
+	}
+
+	return rm.monitor.Status(), true
+}
+
+// SetTargetState sets the administrative state of the given target.
+// Drained and disabled targets are removed from rotation immediately
+// while enabled targets are put back after their next successful
+// check. The established flows of drained targets are kept while the
+// conntrack policy of the service is applied to disabled targets.
+// Without a state store an ErrNoStateStore is returned.
+func (m *Manager) SetTargetState(service, target, state string) (err error) {
+	if err = ValidateAdminState(state); err != nil {
+		return err
+	}
+
+	if m.states == nil {
+		return ErrNoStateStore
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	rm, ok := m.monitors[service]
+	if !ok {
+		return ErrServiceNotFound
+	}
+
+	var tgt *config.Target
+	for i := range rm.svc.Targets {
+		if rm.svc.Targets[i].String() == target {
+			tgt = &rm.svc.Targets[i]
+		}
+	}
+
+	if tgt == nil {
+		return ErrTargetNotFound
+	}
+
+	if err = m.states.Set(service, target, state); err != nil {
+		return fmt.Errorf("storing state: %w", err)
+	}
+
+	m.logger.WithFields(logrus.Fields{
+		"service": service,
+		"target":  target,
+		"state":   state,
+	}).Info("target state changed by operator")
+	rm.monitor.markAdminState(*tgt, state)
+
+	if state == AdminStateEnabled {
+		return nil
+	}
+
+	var removed []common.NATTarget
+	for _, nt := range NATTargets(rm.svc, *tgt) {
+		if m.be.UnregisterServiceTarget(service, nt) {
+			removed = append(removed, nt)
+		}
+	}
+
+	if len(removed) == 0 {
+		return nil
+	}
+
+	if err = m.be.EnsureManagedChains(); err != nil {
+		return fmt.Errorf("updating chains: %w", err)
+	}
+
+	if state == AdminStateDisabled {
+		m.flows.handleRemoved(service, rm.svc.Conntrack, removed)
+	}
+
+	return nil
+}
+
+// Status returns the status of all managed services sorted by name
+func (m *Manager) Status() []ServiceStatus {
+	m.lock.Lock()
+	monitors := make([]*Monitor, 0, len(m.monitors))
+	for _, rm := range m.monitors {
+		monitors = append(monitors, rm.monitor)
+	}
+	m.lock.Unlock()
+
+	status := []ServiceStatus{}
+	for _, mon := range monitors {
+		status = append(status, mon.Status())
+	}
+
+	sort.Slice(status, func(i, j int) bool { return status[i].Name < status[j].Name })
+
+	return status
+}
+
+// Stop stops all running monitors and waits for them to finish
+func (m *Manager) Stop() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for name, rm := range m.monitors {
+		rm.stop()
+		delete(m.monitors, name)
+	}
+
+	m.flows.stop()
+}
+
+func (m *Manager) start(svc config.Service, checker *healthcheck.Composite) {
+	ctx, cancel := context.WithCancel(context.Background())
+	rm := &runningMonitor{
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		monitor: New(m.be, m.states, m.conntrack, m.logger.WithField("service", svc.Name), svc),
+		svc:     svc,
+	}
+	rm.monitor.checker = checker
+	rm.monitor.flows = m.flows
+	m.monitors[svc.Name] = rm
+
+	go func() {
+		defer close(rm.done)
+		if err := rm.monitor.Run(ctx); err != nil {
+			m.errs <- fmt.Errorf("monitoring service %q: %w", svc.Name, err)
+		}
+	}()
+}
+
+// unregisterStaleTargets removes the targets of the old service
+// definition not present in the new one from the backend and returns
+// the removed ones. Targets still present are kept so they continue
+// to receive traffic while the restarted monitor checks them: if only
+// their settings (for example the weight) changed they are replaced
+// by their new definition. The metrics of targets removed from the
+// service are deleted.
+func (m *Manager) unregisterStaleTargets(oldSvc, newSvc config.Service) (changed bool, removed []common.NATTarget) {
+	var (
+		keep    = make(map[common.NATTarget]common.NATTarget)
+		present = make(map[string]bool)
+	)
+
+	for _, t := range newSvc.Targets {
+		present[t.String()] = true
+		for _, nt := range NATTargets(newSvc, t) {
+			keep[sameFlows(nt)] = nt
+		}
+	}
+
+	for _, t := range oldSvc.Targets {
+		if !present[t.String()] {
+			metrics.RemoveTarget(oldSvc.Name, t.String())
+		}
+
+		for _, nt := range NATTargets(oldSvc, t) {
+			replacement, ok := keep[sameFlows(nt)]
+			if ok && replacement == nt {
+				continue
+			}
+
+			if !m.be.UnregisterServiceTarget(oldSvc.Name, nt) {
+				continue
+			}
+			changed = true
+
+			if ok {
+				m.be.RegisterServiceTarget(newSvc.Name, replacement)
+				continue
+			}
+			removed = append(removed, nt)
+		}
+	}
+
+	return changed, removed
+}
+
+// validateService ensures the monitor for the given service can be
+// started and returns its health-checker: the service must be valid,
+// all checks must be known and the backend must support the address
+// families of its targets
+func (m *Manager) validateService(svc config.Service) (*healthcheck.Composite, error) {
+	if err := svc.Validate(); err != nil {
+		return nil, err
+	}
+
+	checker, err := healthcheck.NewComposite(svc.HealthCheck)
+	if err != nil {
+		return nil, fmt.Errorf("creating checker: %w", err)
+	}
+
+	for _, t := range svc.Targets {
+		for _, nt := range NATTargets(svc, t) {
+			if !m.be.SupportsFamily(nt.Family) {
+				return nil, fmt.Errorf("target %q: %s is not supported by the backend", t, nt.Family)
+			}
+		}
+	}
+
+	return checker, nil
+}
+
+func (r *runningMonitor) stop() {
+	r.cancel()
+	<-r.done
+}
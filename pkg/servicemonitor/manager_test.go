@@ -0,0 +1,245 @@
+package servicemonitor
+
+import (
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/common"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/memory"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/conntrack"
+	"github.com/Luzifer/go_helpers/v2/fieldcollection"
+	"github.com/sirupsen/logrus"
+)
+
+type ipv4OnlyBackend struct {
+	*memory.Client
+}
+
+func (ipv4OnlyBackend) SupportsFamily(family string) bool { return family == common.FamilyIPv4 }
+
+func newTestManager(t *testing.T, ct conntrack.Table) (*Manager, *memory.Client) {
+	t.Helper()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	be := memory.New(nil)
+	mgr := NewManager(ipv4OnlyBackend{be}, nil, ct, logrus.NewEntry(logger))
+	t.Cleanup(mgr.Stop)
+
+	return mgr, be
+}
+
+// healthyTargets starts listeners for the given number of targets
+// passing the TCP health-check
+func healthyTargets(t *testing.T, n int) (targets []config.Target) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listening: %s", err)
+		}
+		t.Cleanup(func() { l.Close() }) //nolint:errcheck,gosec
+
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close() //nolint:errcheck,gosec
+			}
+		}()
+
+		targets = append(targets, config.Target{
+			Addr:      "127.0.0.1",
+			LocalAddr: "127.0.0.1",
+			Port:      l.Addr().(*net.TCPAddr).Port,
+			Weight:    1,
+		})
+	}
+
+	return targets
+}
+
+func tcpService(policy config.ServiceConntrack, targets ...config.Target) config.Service {
+	svc := testService(targets...)
+	svc.Conntrack = policy
+	svc.HealthCheck = config.ServiceHealthCheck{
+		Type:     "tcp",
+		Interval: time.Hour,
+		Settings: fieldcollection.NewFieldCollection(),
+	}
+
+	return svc
+}
+
+// waitFor polls the condition until it is met or the timeout passed
+func waitFor(t *testing.T, desc string, cond func() bool) {
+	t.Helper()
+
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+
+	t.Fatalf("timed out waiting for %s", desc)
+}
+
+func flushedPorts(ct *conntrack.Fake) (ports []int) {
+	for _, t := range ct.Flushed() {
+		ports = append(ports, t.Port)
+	}
+
+	return ports
+}
+
+func TestApplyKeepsMonitorsOnInvalidService(t *testing.T) {
+	mgr, be := newTestManager(t, nil)
+
+	svc := testService(config.Target{Addr: "127.0.0.1", LocalAddr: "127.0.0.1", Port: 1, Weight: 1})
+	svc.HealthCheck = config.ServiceHealthCheck{
+		Type:     "tcp",
+		Interval: time.Hour,
+		Settings: fieldcollection.NewFieldCollection(),
+	}
+
+	if err := mgr.Apply([]config.Service{svc}); err != nil {
+		t.Fatalf("applying valid service: %s", err)
+	}
+
+	unknownCheck := svc
+	unknownCheck.HealthCheck.Type = "htp"
+
+	unknownPolicy := svc
+	unknownPolicy.Conntrack.Policy = "drop"
+
+	unsupportedFamily := svc
+	unsupportedFamily.BindAddr = "2001:db8::1"
+	unsupportedFamily.Targets = []config.Target{{Addr: "2001:db8::2", LocalAddr: "2001:db8::fe", Port: 1, Weight: 1}}
+
+	for _, tc := range []struct {
+		svc    config.Service
+		reason string
+	}{
+		{unknownCheck, `checker "htp" not found`},
+		{unknownPolicy, `conntrack: unknown policy "drop"`},
+		{unsupportedFamily, "ipv6 is not supported"},
+	} {
+		err := mgr.Apply([]config.Service{tc.svc})
+		if !errors.Is(err, ErrInvalidService) || !strings.Contains(err.Error(), tc.reason) {
+			t.Errorf("expected invalid service error containing %q, got %v", tc.reason, err)
+		}
+
+		if rm := mgr.monitors[svc.Name]; rm == nil || !reflect.DeepEqual(rm.svc, svc) {
+			t.Errorf("%s: expected running monitor to be kept", tc.reason)
+		}
+	}
+
+	for _, c := range be.Calls() {
+		if c.Method == memory.MethodRemoveService || c.Method == memory.MethodUnregisterTarget {
+			t.Errorf("unexpected call to backend: %+v", c)
+		}
+	}
+}
+
+func TestApplyFlushesRemovedTargets(t *testing.T) {
+	var (
+		ct      = conntrack.NewFake()
+		policy  = config.ServiceConntrack{Policy: config.ConntrackPolicyFlush}
+		targets = healthyTargets(t, 3) //nolint:mnd // Number of targets
+	)
+
+	mgr, be := newTestManager(t, ct)
+
+	web := tcpService(policy, targets[0], targets[1])
+	api := tcpService(policy, targets[2])
+	api.Name = "api"
+	api.BindPort = 81
+
+	if err := mgr.Apply([]config.Service{web, api}); err != nil {
+		t.Fatalf("applying services: %s", err)
+	}
+	waitFor(t, "targets to be registered", func() bool {
+		return len(be.ServiceTargets("web")) == 2 && len(be.ServiceTargets("api")) == 1
+	})
+
+	// Changing the weight of the first target keeps it in rotation
+	// while the second target and the api service are removed
+	web.Targets = []config.Target{targets[0]}
+	web.Targets[0].Weight = 2
+
+	if err := mgr.Apply([]config.Service{web}); err != nil {
+		t.Fatalf("applying services: %s", err)
+	}
+
+	if got := be.ServiceTargets("web"); len(got) != 1 || got[0].Weight != 2 {
+		t.Errorf("expected reweighted target to stay registered, got %v", got)
+	}
+
+	got, expected := flushedPorts(ct), []int{targets[1].Port, targets[2].Port}
+	sort.Ints(got)
+	sort.Ints(expected)
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected ports %v to be flushed, got %v", expected, got)
+	}
+}
+
+func TestApplyKeepsPendingExpiries(t *testing.T) {
+	var (
+		ct      = conntrack.NewFake()
+		policy  = config.ServiceConntrack{Policy: config.ConntrackPolicyExpire, GracePeriod: 200 * time.Millisecond}
+		targets = healthyTargets(t, 2) //nolint:mnd // Number of targets
+	)
+
+	mgr, be := newTestManager(t, ct)
+
+	svc := tcpService(policy, targets...)
+	if err := mgr.Apply([]config.Service{svc}); err != nil {
+		t.Fatalf("applying service: %s", err)
+	}
+	waitFor(t, "targets to be registered", func() bool { return len(be.ServiceTargets("web")) == 2 })
+
+	svc.Targets = targets[:1]
+	if err := mgr.Apply([]config.Service{svc}); err != nil {
+		t.Fatalf("applying service: %s", err)
+	}
+
+	// Restarting the monitor before the grace period passed must not
+	// cancel the expiry of the removed target
+	svc.HealthCheck.Rise = 2
+	if err := mgr.Apply([]config.Service{svc}); err != nil {
+		t.Fatalf("applying service: %s", err)
+	}
+
+	if len(ct.Flushed()) != 0 {
+		t.Fatalf("expected flows not to be flushed before grace period")
+	}
+
+	waitFor(t, "flows to be flushed", func() bool {
+		return reflect.DeepEqual(flushedPorts(ct), []int{targets[1].Port})
+	})
+}
+
+func TestSetTargetStateWithoutStore(t *testing.T) {
+	mgr, _ := newTestManager(t, nil)
+
+	svc := tcpService(config.ServiceConntrack{}, healthyTargets(t, 1)...)
+	if err := mgr.Apply([]config.Service{svc}); err != nil {
+		t.Fatalf("applying service: %s", err)
+	}
+
+	if err := mgr.SetTargetState(svc.Name, svc.Targets[0].String(), AdminStateDrained); !errors.Is(err, ErrNoStateStore) {
+		t.Errorf("expected ErrNoStateStore, got %v", err)
+	}
+}
@@ -3,102 +3,231 @@
 package servicemonitor
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
 
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/common"
 	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/conntrack"
 	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/healthcheck"
-	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/iptables"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/metrics"
 	"github.com/sirupsen/logrus"
 )
 
 type (
 	// Monitor contains the monitoring logic and state
 	Monitor struct {
-		ipt    *iptables.Client
-		logger *logrus.Entry
-		svc    config.Service
+		be        backend.Backend
+		checker   targetChecker
+		conntrack conntrack.Table
+		flows     *flowPolicy
+		logger    *logrus.Entry
+		passive   *passiveCheck
+		states    *AdminStateStore
+		svc       config.Service
+
+		statusLock sync.RWMutex
+		outliers   map[string]*outlierState
+		panicking  bool
+		status     map[string]*TargetStatus
+	}
+
+	// targetChecker executes the health-checks of a single target and
+	// is implemented by the healthcheck.Composite
+	targetChecker interface {
+		Check(target config.Target, observe healthcheck.ObserveFunc) error
 	}
 )
 
-// New creates a new monitor with empty rule set
-func New(ipt *iptables.Client, logger *logrus.Entry, svc config.Service) *Monitor {
+// New creates a new monitor with empty rule set. The states store
+// may be nil in which case all targets are considered enabled, the
+// conntrack table may be nil to never flush any flows (passive
+// health-checks are not available then). Pending expiries of flows
+// are kept when the monitor is stopped.
+func New(be backend.Backend, states *AdminStateStore, ct conntrack.Table, logger *logrus.Entry, svc config.Service) *Monitor {
 	return &Monitor{
-		ipt:    ipt,
-		logger: logger,
-		svc:    svc,
+		be:        be,
+		conntrack: ct,
+		flows:     newFlowPolicy(be, ct, logger),
+		logger:    logger,
+		states:    states,
+		svc:       svc,
+
+		outliers: make(map[string]*outlierState),
+		status:   make(map[string]*TargetStatus),
+	}
+}
+
+// NATTargets converts the given target of the service into the
+// representation used by the rule backends: one NATTarget is created
+// for each bind address of the service the target is routable in
+func NATTargets(svc config.Service, t config.Target) (targets []common.NATTarget) {
+	for _, bindAddr := range svc.BindAddresses() {
+		family := config.BindAddressFamily(bindAddr)
+		if !t.RoutableIn(family) {
+			continue
+		}
+
+		targets = append(targets, common.NATTarget{
+			Addr:            t.Addr,
+			AffinityTimeout: svc.AffinityTimeoutDuration(),
+			Balance:         svc.BalanceMode(),
+			BindAddr:        bindAddr,
+			BindPort:        svc.BindPort,
+			Family:          family,
+			LocalAddr:       t.LocalAddress(family),
+			Port:            t.Port,
+			Priority:        t.PriorityTier(),
+			Weight:          float64(t.Weight),
+			Proto:           svc.Protocol(),
+		})
 	}
+
+	return targets
 }
 
 // Run contains the monitoring loop for the given service and should
 // run in the background. When returning an error the loop is stopped.
-func (m Monitor) Run() (err error) {
-	for {
-		itStart := time.Now()
+// The loop returns without error when the context is cancelled.
+func (m *Monitor) Run(ctx context.Context) (err error) {
+	if m.checker == nil {
+		if m.checker, err = healthcheck.NewComposite(m.svc.HealthCheck); err != nil {
+			return fmt.Errorf("creating checker: %w", err)
+		}
+	}
 
-		checker := healthcheck.ByName(m.svc.HealthCheck.Type)
-		if checker == nil {
-			return fmt.Errorf("checker %q not found", m.svc.HealthCheck.Type)
+	if m.svc.PassiveHealthCheck.Enabled {
+		if err = m.startPassiveCheck(ctx); err != nil {
+			return fmt.Errorf("starting passive health-check: %w", err)
 		}
+	}
+
+	for {
+		itStart := time.Now()
 
-		if err = m.updateRoutingTargets(checker); err != nil {
+		if err = m.updateRoutingTargets(m.checker); err != nil {
 			return fmt.Errorf("updating healthy targets: %w", err)
 		}
 
-		time.Sleep(m.svc.HealthCheck.Interval - time.Since(itStart))
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-time.After(m.svc.HealthCheck.Interval - time.Since(itStart)):
+		}
 	}
 }
 
-func (m Monitor) updateRoutingTargets(checker healthcheck.Checker) (err error) {
+func (m *Monitor) updateRoutingTargets(checker targetChecker) (err error) {
 	var (
 		down, up []string
+		removed  []common.NATTarget
 
 		changed bool
+		results = make([]error, len(m.svc.Targets))
 		wg      sync.WaitGroup
 	)
 	wg.Add(len(m.svc.Targets))
 
 	for i := range m.svc.Targets {
 		t := m.svc.Targets[i]
-		logger := m.logger.WithField("target", fmt.Sprintf("%s:%d", t.Addr, t.Port))
 		go func() {
 			defer wg.Done()
 
-			tgt := iptables.NATTarget{
-				Addr:      t.Addr,
-				BindAddr:  m.svc.BindAddr,
-				BindPort:  m.svc.BindPort,
-				LocalAddr: t.LocalAddr,
-				Port:      t.Port,
-				Weight:    float64(t.Weight),
-				Proto:     m.svc.Protocol(),
-			}
+			results[i] = checker.Check(t, func(checkType string, duration time.Duration, err error) {
+				metrics.ObserveCheck(m.svc.Name, t.String(), checkType, duration, err)
+			})
+			metrics.SetTargetUp(m.svc.Name, t.String(), results[i] == nil)
+		}()
+	}
 
-			if err := checker.Check(m.svc.HealthCheck.Settings, t); err != nil {
-				if m.ipt.UnregisterServiceTarget(m.svc.Name, tgt) {
-					logger.WithError(err).Warn("detected target down")
-					changed = true
-				} else {
-					logger.WithError(err).Debug("detected target down")
-				}
+	wg.Wait()
+
+	if m.passive != nil {
+		m.passive.updateTargets(m.svc)
+	}
 
-				down = append(down, t.String())
-				return
+	inRotation := make([]bool, len(m.svc.Targets))
+	for i, t := range m.svc.Targets {
+		if results[i] == nil && m.passive != nil {
+			results[i] = m.passive.evaluate(t.String(), time.Now())
+		}
+
+		inRotation[i] = m.evaluateCheck(t, results[i])
+	}
+
+	panicMode, panicTier := m.evaluatePanic(inRotation)
+
+	for i, t := range m.svc.Targets {
+		var (
+			checkErr   = results[i]
+			logger     = m.logger.WithField("target", t.String())
+			tgtChanged bool
+		)
+
+		if checkErr != nil {
+			logger = logger.WithError(checkErr)
+		}
+
+		if !inRotation[i] {
+			down = append(down, t.String())
+		} else {
+			up = append(up, t.String())
+		}
+
+		// Only the targets of the tier in panic are affected by it
+		inPanic := !inRotation[i] && panicMode != "" && t.PriorityTier() == panicTier
+
+		if inPanic && panicMode == config.PanicModeFreeze {
+			// Keep the target as it was before the panic
+			logger.Debug("detected target down, keeping it due to panic")
+			continue
+		}
+
+		panicRouted := inPanic && panicMode == config.PanicModeAll &&
+			m.states.Get(m.svc.Name, t.String()) == AdminStateEnabled
+
+		if !inRotation[i] && !panicRouted {
+			for _, tgt := range NATTargets(m.svc, t) {
+				if m.be.UnregisterServiceTarget(m.svc.Name, tgt) {
+					tgtChanged = true
+					removed = append(removed, tgt)
+				}
 			}
 
-			if m.ipt.RegisterServiceTarget(m.svc.Name, tgt) {
-				logger.Info("target up")
+			if tgtChanged {
+				logger.Warn("detected target down")
 				changed = true
 			} else {
-				logger.Debug("target up")
+				logger.Debug("detected target down")
 			}
 
-			up = append(up, t.String())
-		}()
-	}
+			continue
+		}
 
-	wg.Wait()
+		for _, tgt := range NATTargets(m.svc, t) {
+			if m.be.RegisterServiceTarget(m.svc.Name, tgt) {
+				tgtChanged = true
+				m.flows.cancel(m.svc.Name, tgt)
+			}
+		}
+
+		switch {
+		case tgtChanged && panicRouted:
+			logger.Warn("detected target down, routing to it due to panic")
+			changed = true
+		case tgtChanged:
+			logger.Info("target up")
+			changed = true
+		case panicRouted:
+			logger.Debug("detected target down, routing to it due to panic")
+		default:
+			logger.Debug("target up")
+		}
+	}
 
 	uplog := m.logger.WithFields(logrus.Fields{
 		"down": down,
@@ -118,9 +247,10 @@ func (m Monitor) updateRoutingTargets(checker healthcheck.Checker) (err error) {
 		return nil
 	}
 
-	if err = m.ipt.EnsureManagedChains(); err != nil {
+	if err = m.be.EnsureManagedChains(); err != nil {
 		return fmt.Errorf("updating chains: %w", err)
 	}
 
+	m.flows.handleRemoved(m.svc.Name, m.svc.Conntrack, removed)
 	return nil
 }
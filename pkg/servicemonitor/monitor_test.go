@@ -0,0 +1,415 @@
+package servicemonitor
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/common"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/memory"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/healthcheck"
+	"github.com/sirupsen/logrus"
+)
+
+type stubChecker struct {
+	lock    sync.Mutex
+	results map[string]error
+}
+
+func (s *stubChecker) Check(t config.Target, _ healthcheck.ObserveFunc) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.results[t.String()]
+}
+
+func (s *stubChecker) set(target string, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.results[target] = err
+}
+
+func newTestMonitor(t *testing.T, svc config.Service) (*Monitor, *memory.Client) {
+	t.Helper()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	be := memory.New(nil)
+	return New(be, nil, nil, logrus.NewEntry(logger), svc), be
+}
+
+func testService(targets ...config.Target) config.Service {
+	return config.Service{
+		Name:     "web",
+		BindAddr: "10.0.0.1",
+		BindPort: 80,
+		Proto:    "tcp",
+		Targets:  targets,
+	}
+}
+
+func snapshotAddrs(snapshot map[string][]common.NATTarget, service string) (addrs []string) {
+	for _, t := range snapshot[service] {
+		addrs = append(addrs, t.Addr)
+	}
+
+	return addrs
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestUpdateRoutingTargets(t *testing.T) {
+	var (
+		a = config.Target{Addr: "10.1.0.1", Port: 8080, Weight: 1}
+		b = config.Target{Addr: "10.1.0.2", Port: 8080, Weight: 1}
+
+		checker = &stubChecker{results: map[string]error{}}
+	)
+
+	m, be := newTestMonitor(t, testService(a, b))
+
+	for _, step := range []struct {
+		name      string
+		results   map[string]error
+		snapshots int
+		active    []string
+	}{
+		{"initial", map[string]error{}, 1, []string{"10.1.0.1", "10.1.0.2"}},
+		{"unchanged", map[string]error{}, 1, []string{"10.1.0.1", "10.1.0.2"}},
+		{"target down", map[string]error{b.String(): errors.New("refused")}, 2, []string{"10.1.0.1"}},
+		{"target still down", map[string]error{b.String(): errors.New("refused")}, 2, []string{"10.1.0.1"}},
+		{"target up", map[string]error{}, 3, []string{"10.1.0.1", "10.1.0.2"}},
+	} {
+		checker.set(b.String(), step.results[b.String()])
+
+		if err := m.updateRoutingTargets(checker); err != nil {
+			t.Fatalf("%s: updating routing targets: %s", step.name, err)
+		}
+
+		snapshots := be.Snapshots()
+		if len(snapshots) != step.snapshots {
+			t.Fatalf("%s: expected %d snapshots, got %d", step.name, step.snapshots, len(snapshots))
+		}
+
+		if got := snapshotAddrs(snapshots[len(snapshots)-1], "web"); !equalStrings(got, step.active) {
+			t.Errorf("%s: expected targets %v, got %v", step.name, step.active, got)
+		}
+	}
+
+	var unregistered int
+	for _, c := range be.Calls() {
+		if c.Method == memory.MethodUnregisterTarget && c.Changed {
+			unregistered++
+			if c.Target.Addr != b.Addr {
+				t.Errorf("unexpected target unregistered: %s", c.Target)
+			}
+		}
+	}
+
+	if unregistered != 1 {
+		t.Errorf("expected target to be unregistered once, got %d", unregistered)
+	}
+}
+
+func TestUpdateRoutingTargetsFall(t *testing.T) {
+	var (
+		a = config.Target{Addr: "10.1.0.1", Port: 8080, Weight: 1}
+
+		checker = &stubChecker{results: map[string]error{}}
+		svc     = testService(a)
+	)
+
+	svc.HealthCheck.Fall = 2
+	m, be := newTestMonitor(t, svc)
+
+	for i, expectRegistered := range []bool{true, true, false} {
+		if i > 0 {
+			checker.set(a.String(), errors.New("refused"))
+		}
+
+		if err := m.updateRoutingTargets(checker); err != nil {
+			t.Fatalf("check %d: updating routing targets: %s", i, err)
+		}
+
+		if registered := len(be.ServiceTargets("web")) > 0; registered != expectRegistered {
+			t.Errorf("check %d: expected target registered = %v", i, expectRegistered)
+		}
+	}
+}
+
+func TestUpdateRoutingTargetsRise(t *testing.T) {
+	var (
+		a = config.Target{Addr: "10.1.0.1", Port: 8080, Weight: 1}
+
+		checker = &stubChecker{results: map[string]error{a.String(): errors.New("refused")}}
+		svc     = testService(a)
+	)
+
+	svc.HealthCheck.Rise = 2
+	m, be := newTestMonitor(t, svc)
+
+	for i, expectRegistered := range []bool{false, false, true} {
+		if i > 0 {
+			checker.set(a.String(), nil)
+		}
+
+		if err := m.updateRoutingTargets(checker); err != nil {
+			t.Fatalf("check %d: updating routing targets: %s", i, err)
+		}
+
+		if registered := len(be.ServiceTargets("web")) > 0; registered != expectRegistered {
+			t.Errorf("check %d: expected target registered = %v", i, expectRegistered)
+		}
+	}
+}
+
+func TestUpdateRoutingTargetsAdminState(t *testing.T) {
+	var (
+		a = config.Target{Addr: "10.1.0.1", Port: 8080, Weight: 1}
+		b = config.Target{Addr: "10.1.0.2", Port: 8080, Weight: 1}
+
+		checker = &stubChecker{results: map[string]error{}}
+	)
+
+	states, err := NewAdminStateStore("")
+	if err != nil {
+		t.Fatalf("creating state store: %s", err)
+	}
+
+	m, be := newTestMonitor(t, testService(a, b))
+	m.states = states
+
+	if err = states.Set("web", b.String(), AdminStateDrained); err != nil {
+		t.Fatalf("setting state: %s", err)
+	}
+
+	if err = m.updateRoutingTargets(checker); err != nil {
+		t.Fatalf("updating routing targets: %s", err)
+	}
+
+	if got := snapshotAddrs(be.Snapshots()[0], "web"); !equalStrings(got, []string{"10.1.0.1"}) {
+		t.Errorf("expected drained target not to be routed, got %v", got)
+	}
+
+	if ts := m.Status().Targets[1]; ts.InRotation || ts.AdminState != AdminStateDrained {
+		t.Errorf("expected drained target out of rotation, got %+v", ts)
+	}
+}
+
+func TestUpdateRoutingTargetsOutlier(t *testing.T) {
+	var (
+		a = config.Target{Addr: "10.1.0.1", Port: 8080, Weight: 1}
+		b = config.Target{Addr: "10.1.0.2", Port: 8080, Weight: 1}
+
+		checker = &stubChecker{results: map[string]error{}}
+		svc     = testService(a, b)
+	)
+
+	svc.OutlierDetection = config.ServiceOutlierDetection{Enabled: true, Ejections: 2}
+	m, be := newTestMonitor(t, svc)
+
+	for i, step := range []struct {
+		err        error
+		registered bool
+	}{
+		{nil, true},
+		{errors.New("refused"), false},
+		{nil, true},
+		// Second time taken out of rotation within the window: ejected
+		{errors.New("refused"), false},
+		{nil, false},
+	} {
+		checker.set(b.String(), step.err)
+
+		if err := m.updateRoutingTargets(checker); err != nil {
+			t.Fatalf("check %d: updating routing targets: %s", i, err)
+		}
+
+		registered := len(be.ServiceTargets("web")) == 2
+		if registered != step.registered {
+			t.Errorf("check %d: expected target registered = %v", i, step.registered)
+		}
+	}
+
+	if ts := m.Status().Targets[1]; ts.EjectedUntil == nil || !ts.Healthy {
+		t.Errorf("expected healthy target to be ejected, got %+v", ts)
+	}
+}
+
+func TestUpdateRoutingTargetsPanic(t *testing.T) {
+	var (
+		a = config.Target{Addr: "10.1.0.1", Port: 8080, Weight: 1}
+		b = config.Target{Addr: "10.1.0.2", Port: 8080, Weight: 1}
+	)
+
+	for _, tc := range []struct {
+		mode   string
+		active []string
+	}{
+		{config.PanicModeAll, []string{"10.1.0.1", "10.1.0.2"}},
+		{config.PanicModeFreeze, []string{"10.1.0.1"}},
+	} {
+		var (
+			checker = &stubChecker{results: map[string]error{b.String(): errors.New("refused")}}
+			svc     = testService(a, b)
+		)
+
+		svc.Panic = config.ServicePanic{Threshold: 50, Mode: tc.mode}
+		m, be := newTestMonitor(t, svc)
+
+		// One of two targets healthy is not below the threshold
+		if err := m.updateRoutingTargets(checker); err != nil {
+			t.Fatalf("%s: updating routing targets: %s", tc.mode, err)
+		}
+
+		if m.Status().Panic {
+			t.Errorf("%s: expected service not to panic", tc.mode)
+		}
+
+		checker.set(a.String(), errors.New("refused"))
+		if err := m.updateRoutingTargets(checker); err != nil {
+			t.Fatalf("%s: updating routing targets: %s", tc.mode, err)
+		}
+
+		if !m.Status().Panic {
+			t.Errorf("%s: expected service to panic", tc.mode)
+		}
+
+		if got := snapshotAddrs(be.Snapshots()[len(be.Snapshots())-1], "web"); !equalStrings(got, tc.active) {
+			t.Errorf("%s: expected targets %v, got %v", tc.mode, tc.active, got)
+		}
+	}
+}
+
+func TestStatusRules(t *testing.T) {
+	a := config.Target{Addr: "10.1.0.1", Port: 8080, Weight: 1}
+
+	m, be := newTestMonitor(t, testService(a))
+
+	// Registered but not yet applied targets are not reported
+	be.RegisterServiceTarget("web", NATTargets(m.svc, a)[0])
+	if rules := m.Status().Rules; len(rules) != 0 {
+		t.Errorf("expected no rules before applying, got %v", rules)
+	}
+
+	if err := be.EnsureManagedChains(); err != nil {
+		t.Fatalf("applying rules: %s", err)
+	}
+
+	if rules := m.Status().Rules; !equalStrings(rules, []string{"tcp 10.0.0.1:80 -> 10.1.0.1:8080"}) {
+		t.Errorf("unexpected rules: %v", rules)
+	}
+}
+
+func TestUpdateRoutingTargetsPanicTiers(t *testing.T) {
+	var (
+		primary1 = config.Target{Addr: "10.1.0.1", Port: 8080, Weight: 1}
+		primary2 = config.Target{Addr: "10.1.0.2", Port: 8080, Weight: 1}
+		backup   = config.Target{Addr: "10.1.0.3", Port: 8080, Weight: 1, Backup: true}
+		refused  = errors.New("refused")
+	)
+
+	for _, tc := range []struct {
+		name       string
+		mode       string
+		results    map[string]error
+		panic      bool
+		registered []string
+	}{
+		{
+			name:       "healthy backup wins over panic",
+			mode:       config.PanicModeAll,
+			results:    map[string]error{primary1.String(): refused, primary2.String(): refused},
+			registered: []string{"10.1.0.3"},
+		},
+		{
+			name:       "healthy backup wins over freeze",
+			mode:       config.PanicModeFreeze,
+			results:    map[string]error{primary1.String(): refused, primary2.String(): refused},
+			registered: []string{"10.1.0.3"},
+		},
+		{
+			name:       "panic within primary tier",
+			mode:       config.PanicModeAll,
+			results:    map[string]error{primary1.String(): refused, primary2.String(): refused, backup.String(): refused},
+			panic:      true,
+			registered: []string{"10.1.0.1", "10.1.0.2"},
+		},
+		{
+			name:       "freeze within primary tier",
+			mode:       config.PanicModeFreeze,
+			results:    map[string]error{primary1.String(): refused, primary2.String(): refused, backup.String(): refused},
+			panic:      true,
+			registered: []string{"10.1.0.1", "10.1.0.2"},
+		},
+	} {
+		var (
+			checker = &stubChecker{results: map[string]error{}}
+			svc     = testService(primary1, primary2, backup)
+		)
+
+		svc.Panic = config.ServicePanic{Threshold: 50, Mode: tc.mode}
+		m, be := newTestMonitor(t, svc)
+
+		if err := m.updateRoutingTargets(checker); err != nil {
+			t.Fatalf("%s: updating routing targets: %s", tc.name, err)
+		}
+
+		checker.results = tc.results
+		if err := m.updateRoutingTargets(checker); err != nil {
+			t.Fatalf("%s: updating routing targets: %s", tc.name, err)
+		}
+
+		if m.Status().Panic != tc.panic {
+			t.Errorf("%s: expected panic = %v", tc.name, tc.panic)
+		}
+
+		if got := snapshotAddrs(be.Snapshots()[len(be.Snapshots())-1], "web"); !equalStrings(got, tc.registered) {
+			t.Errorf("%s: expected targets %v, got %v", tc.name, tc.registered, got)
+		}
+	}
+}
+
+func TestNATTargetsHostnameBind(t *testing.T) {
+	svc := testService(
+		config.Target{Addr: "10.1.0.1", LocalAddr: "10.1.0.254", Port: 8080, Weight: 1},
+		config.Target{Addr: "2001:db8::11", LocalAddr: "2001:db8::fe", Port: 8080, Weight: 1},
+	)
+	svc.BindAddr = "lb.example.com"
+	svc.BindAddrs = []string{"2001:db8::1"}
+	svc.HealthCheck.Type = "tcp"
+
+	if err := svc.Validate(); err != nil {
+		t.Fatalf("validating service bound to hostname: %s", err)
+	}
+
+	for _, tc := range []struct {
+		target   config.Target
+		bindAddr string
+		family   string
+	}{
+		{svc.Targets[0], "lb.example.com", common.FamilyIPv4},
+		{svc.Targets[1], "2001:db8::1", common.FamilyIPv6},
+	} {
+		nts := NATTargets(svc, tc.target)
+		if len(nts) != 1 || nts[0].BindAddr != tc.bindAddr || nts[0].Family != tc.family {
+			t.Errorf("target %s: unexpected NAT targets %+v", tc.target, nts)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package servicemonitor
+
+import (
+	"fmt"
+	"time"
+)
+
+type (
+	// outlierState tracks when a target was taken out of rotation and
+	// until when it is ejected for being an outlier
+	outlierState struct {
+		ejections []time.Time
+		until     time.Time
+	}
+)
+
+// applyOutlierDetection keeps targets out of rotation which were taken
+// out of rotation too often within the window of the outlier
+// detection. The ejection time grows exponentially with every further
+// ejection of the target. The statusLock must be held by the caller.
+func (m *Monitor) applyOutlierDetection(ts *TargetStatus, inRotation bool, now time.Time) bool {
+	od := m.svc.OutlierDetection
+
+	o, ok := m.outliers[ts.Target]
+	if !ok {
+		o = &outlierState{}
+		m.outliers[ts.Target] = o
+	}
+
+	cutoff := now.Add(-od.WindowDuration())
+	for len(o.ejections) > 0 && o.ejections[0].Before(cutoff) {
+		o.ejections = o.ejections[1:]
+	}
+
+	switch {
+	case ts.InRotation && !inRotation:
+		// Target is taken out of rotation right now
+		o.ejections = append(o.ejections, now)
+
+		excess := len(o.ejections) - od.EjectionThreshold() + 1
+		if excess < 1 {
+			return false
+		}
+
+		if ejected, maxEjected := m.ejectedOutliers(ts.Target, now), od.MaxEjected(len(m.svc.Targets)); ejected >= maxEjected {
+			m.logger.WithField("target", ts.Target).Warnf(
+				"not ejecting outlier target: %d/%d targets already ejected", ejected, maxEjected,
+			)
+			return false
+		}
+
+		o.until = now.Add(od.EjectionTime(excess))
+		m.logger.WithField("target", ts.Target).Warnf(
+			"ejecting outlier target for %s: taken out of rotation %d times within %s",
+			od.EjectionTime(excess), len(o.ejections), od.WindowDuration(),
+		)
+
+	case !now.Before(o.until):
+		// Target is not ejected
+		ts.EjectedUntil = nil
+		return inRotation
+	}
+
+	until := o.until
+	ts.EjectedUntil = &until
+	ts.Reason = fmt.Sprintf("ejected as outlier until %s", until.Format(time.RFC3339))
+
+	return false
+}
+
+// ejectedOutliers returns the number of targets other than the given
+// one currently ejected for being an outlier. The statusLock must be
+// held by the caller.
+func (m *Monitor) ejectedOutliers(except string, now time.Time) (n int) {
+	for target, o := range m.outliers {
+		if target != except && now.Before(o.until) {
+			n++
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,92 @@
+package servicemonitor
+
+import (
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// evaluatePanic decides whether the service is in panic as less than
+// the panic threshold of the targets enabled by the operator within
+// the priority tier to be routed to are in rotation. That tier is the
+// lowest one having targets in rotation (the lowest one having enabled
+// targets if none is in rotation) so a healthy backup tier is always
+// preferred over routing to the targets of a panicking tier. Returns
+// the panic mode to apply (empty if the service is not in panic) and
+// the tier the mode applies to.
+func (m *Monitor) evaluatePanic(inRotation []bool) (mode string, tier int) {
+	var (
+		enabled, healthy int
+		lowestEnabled    = -1
+	)
+
+	tier = -1
+	for i, t := range m.svc.Targets {
+		if m.states.Get(m.svc.Name, t.String()) != AdminStateEnabled {
+			continue
+		}
+
+		p := t.PriorityTier()
+		if lowestEnabled < 0 || p < lowestEnabled {
+			lowestEnabled = p
+		}
+
+		if inRotation[i] && (tier < 0 || p < tier) {
+			tier = p
+		}
+	}
+
+	if tier < 0 {
+		tier = lowestEnabled
+	}
+
+	for i, t := range m.svc.Targets {
+		if t.PriorityTier() != tier || m.states.Get(m.svc.Name, t.String()) != AdminStateEnabled {
+			continue
+		}
+
+		enabled++
+		if inRotation[i] {
+			healthy++
+		}
+	}
+
+	panicking := m.svc.Panic.Threshold > 0 && enabled > 0 &&
+		healthy*100 < m.svc.Panic.Threshold*enabled //nolint:mnd // Percentage
+
+	m.statusLock.Lock()
+	changed := m.panicking != panicking
+	m.panicking = panicking
+	m.statusLock.Unlock()
+
+	metrics.SetServicePanic(m.svc.Name, panicking)
+
+	logger := m.logger.WithFields(logrus.Fields{
+		"healthy":   healthy,
+		"mode":      m.svc.Panic.PanicMode(),
+		"targets":   enabled,
+		"threshold": m.svc.Panic.Threshold,
+		"tier":      tier,
+	})
+
+	switch {
+	case panicking && changed:
+		msg := "PANIC: too few healthy targets, routing to all targets regardless of their health"
+		if m.svc.Panic.PanicMode() == config.PanicModeFreeze {
+			msg = "PANIC: too few healthy targets, freezing the last known good targets"
+		}
+		logger.Error(msg)
+
+	case panicking:
+		logger.Warn("service still in panic")
+
+	case changed:
+		logger.Info("enough healthy targets, leaving panic")
+	}
+
+	if !panicking {
+		return "", tier
+	}
+
+	return m.svc.Panic.PanicMode(), tier
+}
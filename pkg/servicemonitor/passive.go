@@ -0,0 +1,257 @@
+package servicemonitor
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend/common"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/conntrack"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/metrics"
+)
+
+// Outcomes of the flows as classified by the passive health-check
+const (
+	flowOutcomeOK        = "ok"
+	flowOutcomeReset     = "reset"
+	flowOutcomeTimeout   = "timeout"
+	flowOutcomeUnreplied = "unreplied"
+)
+
+// passiveBuckets defines into how many buckets the window is split
+// to expire old flows
+const passiveBuckets = 10
+
+type (
+	// passiveCheck counts the outcomes of the flows DNATed to the
+	// targets of a service within a sliding window
+	passiveCheck struct {
+		cfg config.ServicePassiveHealthCheck
+
+		lock    sync.Mutex
+		binds   map[string]bool
+		flows   map[string][]*flowBucket
+		resets  map[conntrack.Tuple]time.Time
+		targets map[string]string
+	}
+
+	flowBucket struct {
+		start    time.Time
+		total    int
+		outcomes map[string]int
+	}
+)
+
+func newPassiveCheck(cfg config.ServicePassiveHealthCheck) *passiveCheck {
+	return &passiveCheck{
+		cfg:     cfg,
+		binds:   make(map[string]bool),
+		flows:   make(map[string][]*flowBucket),
+		resets:  make(map[conntrack.Tuple]time.Time),
+		targets: make(map[string]string),
+	}
+}
+
+// startPassiveCheck subscribes to the conntrack events of the flows
+// sent to the service in all families it is bound in and feeds them
+// into the passive check until the context is cancelled
+func (m *Monitor) startPassiveCheck(ctx context.Context) error {
+	if m.conntrack == nil {
+		return fmt.Errorf("no connection tracking available")
+	}
+
+	m.passive = newPassiveCheck(m.svc.PassiveHealthCheck)
+	m.passive.updateTargets(m.svc)
+
+	for _, bindAddr := range m.svc.BindAddresses() {
+		events, err := m.conntrack.Events(ctx, conntrack.EventFilter{
+			Family:      config.BindAddressFamily(bindAddr),
+			Proto:       m.svc.Protocol(),
+			OrigDstPort: m.svc.BindPort,
+		})
+		if err != nil {
+			return fmt.Errorf("subscribing to conntrack events: %w", err)
+		}
+
+		go func() {
+			for ev := range events {
+				if target, outcome := m.passive.handle(ev, time.Now()); target != "" {
+					metrics.ObservePassiveFlow(m.svc.Name, target, outcome)
+				}
+			}
+
+			if ctx.Err() == nil {
+				m.logger.Error("conntrack events stopped, passive health-check is blind")
+			}
+		}()
+	}
+
+	return nil
+}
+
+// evaluate returns an error if the share of failed flows to the
+// target within the window exceeds the configured threshold
+func (p *passiveCheck) evaluate(target string, now time.Time) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.expire(now)
+
+	var (
+		failed   int
+		outcomes = make(map[string]int)
+		total    int
+	)
+
+	for _, b := range p.flows[target] {
+		total += b.total
+		for outcome, n := range b.outcomes {
+			outcomes[outcome] += n
+			failed += n
+		}
+	}
+
+	if total < p.cfg.MinFlowCount() || float64(failed)/float64(total) <= p.cfg.ErrorRateThreshold() {
+		return nil
+	}
+
+	classes := make([]string, 0, len(outcomes))
+	for outcome, n := range outcomes {
+		classes = append(classes, fmt.Sprintf("%s: %d", outcome, n))
+	}
+	sort.Strings(classes)
+
+	return fmt.Errorf(
+		"passive: %d/%d flows failed within %s (%s)",
+		failed, total, p.cfg.WindowDuration(), strings.Join(classes, ", "),
+	)
+}
+
+// expire removes the buckets and remembered resets having left the
+// window, the lock must be held by the caller
+func (p *passiveCheck) expire(now time.Time) {
+	cutoff := now.Add(-p.cfg.WindowDuration())
+
+	for target, buckets := range p.flows {
+		for len(buckets) > 0 && !buckets[0].start.After(cutoff) {
+			buckets = buckets[1:]
+		}
+
+		if len(buckets) == 0 {
+			delete(p.flows, target)
+			continue
+		}
+		p.flows[target] = buckets
+	}
+
+	for tuple, seen := range p.resets {
+		if seen.Before(cutoff) {
+			delete(p.resets, tuple)
+		}
+	}
+}
+
+// handle classifies the event and records the outcome of the flow
+// for the target it was sent to. Flows are counted when they are
+// destroyed: resets are remembered from the preceding update into
+// the CLOSE state. The target is empty when the event did not
+// complete a flow to a known target.
+func (p *passiveCheck) handle(ev conntrack.Event, now time.Time) (target, outcome string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.binds[p.key(ev.Orig.Dst, ev.Orig.DstPort)] {
+		return "", ""
+	}
+
+	target, ok := p.targets[p.key(ev.Reply.Src, ev.Reply.SrcPort)]
+	if !ok {
+		return "", ""
+	}
+
+	switch {
+	case ev.Type == conntrack.EventUpdate && ev.State == "CLOSE":
+		p.resets[ev.Orig] = now
+		return "", ""
+
+	case ev.Type != conntrack.EventDestroy:
+		return "", ""
+	}
+
+	_, reset := p.resets[ev.Orig]
+	delete(p.resets, ev.Orig)
+
+	switch {
+	case reset:
+		outcome = flowOutcomeReset
+	case ev.Unreplied:
+		outcome = flowOutcomeUnreplied
+	case ev.Proto == "tcp" && !ev.Assured:
+		// The handshake was never completed
+		outcome = flowOutcomeTimeout
+	default:
+		outcome = flowOutcomeOK
+	}
+
+	buckets := p.flows[target]
+	if len(buckets) == 0 || now.Sub(buckets[len(buckets)-1].start) >= p.cfg.WindowDuration()/passiveBuckets {
+		buckets = append(buckets, &flowBucket{start: now, outcomes: make(map[string]int)})
+		p.flows[target] = buckets
+	}
+
+	b := buckets[len(buckets)-1]
+	b.total++
+	if outcome != flowOutcomeOK {
+		b.outcomes[outcome]++
+	}
+
+	return target, outcome
+}
+
+// key normalizes the given address and port to match the format of
+// the conntrack events
+func (*passiveCheck) key(addr string, port int) string {
+	if ip := net.ParseIP(addr); ip != nil {
+		addr = ip.String()
+	}
+
+	return net.JoinHostPort(addr, strconv.Itoa(port))
+}
+
+// updateTargets resolves the bind addresses and targets of the
+// service to match them against the addresses in the events
+func (p *passiveCheck) updateTargets(svc config.Service) {
+	var (
+		binds   = make(map[string]bool)
+		targets = make(map[string]string)
+	)
+
+	for _, t := range svc.Targets {
+		for _, nt := range NATTargets(svc, t) {
+			bindAddr, err := common.TranslateToIP(nt.BindAddr, nt.Family)
+			if err != nil {
+				continue
+			}
+
+			addr, err := common.TranslateToIP(nt.Addr, nt.Family)
+			if err != nil {
+				continue
+			}
+
+			binds[p.key(bindAddr, nt.BindPort)] = true
+			targets[p.key(addr, nt.Port)] = t.String()
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.binds = binds
+	p.targets = targets
+}
@@ -0,0 +1,107 @@
+package servicemonitor
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/conntrack"
+)
+
+func TestPassiveCheck(t *testing.T) {
+	var (
+		ct     = conntrack.NewFake()
+		target = config.Target{Addr: "10.1.2.4", LocalAddr: "10.1.2.1", Port: 443, Weight: 1}
+		svc    = config.Service{
+			Name:     "web",
+			BindAddr: "203.0.113.1",
+			BindPort: 443,
+			PassiveHealthCheck: config.ServicePassiveHealthCheck{
+				Enabled:      true,
+				Window:       time.Minute,
+				MinFlows:     4,
+				MaxErrorRate: 0.5,
+			},
+			Targets: []config.Target{target},
+		}
+	)
+
+	m, _ := newTestMonitor(t, svc)
+	m.conntrack = ct
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := m.startPassiveCheck(ctx); err != nil {
+		t.Fatalf("starting passive check: %s", err)
+	}
+
+	flow := func(sport int) (orig, reply conntrack.Tuple) {
+		return conntrack.Tuple{Src: "192.0.2.1", Dst: "203.0.113.1", SrcPort: sport, DstPort: 443},
+			conntrack.Tuple{Src: "10.1.2.4", Dst: "10.1.2.1", SrcPort: 443, DstPort: sport}
+	}
+
+	emit := func(typ, state string, sport int, assured, unreplied bool) {
+		orig, reply := flow(sport)
+		ct.Emit(conntrack.Event{
+			Type:      typ,
+			Proto:     "tcp",
+			State:     state,
+			Orig:      orig,
+			Reply:     reply,
+			Assured:   assured,
+			Unreplied: unreplied,
+		})
+	}
+
+	flows := func() (total int) {
+		m.passive.lock.Lock()
+		defer m.passive.lock.Unlock()
+
+		for _, b := range m.passive.flows[target.String()] {
+			total += b.total
+		}
+		return total
+	}
+
+	// Reset: the update into CLOSE is remembered until the flow is
+	// destroyed and not counted on its own
+	emit(conntrack.EventUpdate, "CLOSE", 1001, true, false)
+	emit(conntrack.EventDestroy, "", 1001, true, false)
+	emit(conntrack.EventDestroy, "", 1002, false, true)
+	emit(conntrack.EventDestroy, "", 1003, false, false)
+
+	// Flows of other families and ports are not counted
+	ct.Emit(conntrack.Event{Type: conntrack.EventDestroy, Proto: "tcp", Orig: conntrack.Tuple{Dst: "2001:db8::1", DstPort: 443}})
+	ct.Emit(conntrack.Event{Type: conntrack.EventDestroy, Proto: "tcp", Orig: conntrack.Tuple{Dst: "203.0.113.1", DstPort: 80}})
+
+	waitFor(t, "failed flows to be counted", func() bool { return flows() == 3 })
+
+	if err := m.passive.evaluate(target.String(), time.Now()); err != nil {
+		t.Errorf("expected no error below the minimum flow count, got %s", err)
+	}
+
+	emit(conntrack.EventDestroy, "", 1004, true, false)
+	waitFor(t, "successful flow to be counted", func() bool { return flows() == 4 })
+
+	err := m.passive.evaluate(target.String(), time.Now())
+	if err == nil {
+		t.Fatal("expected error for error rate above threshold")
+	}
+
+	for _, expected := range []string{"3/4 flows failed", "reset: 1", "timeout: 1", "unreplied: 1"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error %q to contain %q", err, expected)
+		}
+	}
+
+	if err = m.passive.evaluate(target.String(), time.Now().Add(svc.PassiveHealthCheck.Window+time.Second)); err != nil {
+		t.Errorf("expected flows to expire with the window, got %s", err)
+	}
+
+	if n := flows(); n != 0 {
+		t.Errorf("expected expired flows to be removed, got %d", n)
+	}
+}
@@ -0,0 +1,186 @@
+package servicemonitor
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/config"
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/healthcheck"
+)
+
+type (
+	// ServiceStatus describes the current state of a service and its
+	// targets as seen by the monitor
+	ServiceStatus struct {
+		Name      string         `json:"name"`
+		BindAddrs []string       `json:"bindAddrs"`
+		BindPort  int            `json:"bindPort"`
+		Proto     string         `json:"proto"`
+		Panic     bool           `json:"panic"`
+		Targets   []TargetStatus `json:"targets"`
+		Rules     []string       `json:"rules"`
+	}
+
+	// TargetStatus describes the current state of a single target as
+	// seen by the monitor
+	TargetStatus struct {
+		Target               string     `json:"target"`
+		Weight               int        `json:"weight"`
+		Healthy              bool       `json:"healthy"`
+		InRotation           bool       `json:"inRotation"`
+		AdminState           string     `json:"adminState"`
+		Reason               string     `json:"reason"`
+		ConsecutiveFailures  int        `json:"consecutiveFailures"`
+		ConsecutiveSuccesses int        `json:"consecutiveSuccesses"`
+		LastCheck            time.Time  `json:"lastCheck"`
+		LastError            string     `json:"lastError,omitempty"`
+		FailedChecks         []string   `json:"failedChecks,omitempty"`
+		LastChange           time.Time  `json:"lastChange"`
+		EjectedUntil         *time.Time `json:"ejectedUntil,omitempty"`
+	}
+)
+
+// Status returns the current state of the monitored service including
+// the rules currently applied for it
+func (m *Monitor) Status() ServiceStatus {
+	rules := m.be.ServiceRules(m.svc.Name)
+
+	m.statusLock.RLock()
+	defer m.statusLock.RUnlock()
+
+	status := ServiceStatus{
+		Name:      m.svc.Name,
+		BindAddrs: m.svc.BindAddresses(),
+		BindPort:  m.svc.BindPort,
+		Proto:     m.svc.Protocol(),
+		Panic:     m.panicking,
+		Targets:   []TargetStatus{},
+		Rules:     rules,
+	}
+
+	for _, t := range m.svc.Targets {
+		ts, ok := m.status[t.String()]
+		if !ok {
+			// Not yet checked
+			status.Targets = append(status.Targets, TargetStatus{
+				Target:     t.String(),
+				Weight:     t.Weight,
+				AdminState: m.states.Get(m.svc.Name, t.String()),
+				Reason:     "not yet checked",
+			})
+			continue
+		}
+
+		status.Targets = append(status.Targets, *ts)
+	}
+
+	return status
+}
+
+// markAdminState updates the status of the given target after the
+// operator changed its administrative state
+func (m *Monitor) markAdminState(t config.Target, state string) {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+
+	ts, ok := m.status[t.String()]
+	if !ok {
+		return
+	}
+
+	ts.AdminState = state
+	if state == AdminStateEnabled {
+		ts.Reason = "enabled by operator, waiting for next check"
+		return
+	}
+
+	if ts.InRotation {
+		ts.LastChange = time.Now()
+	}
+	ts.InRotation = false
+	ts.Reason = state + " by operator"
+}
+
+// evaluateCheck records the result of the check for the given target
+// and decides whether the target should be in rotation considering
+// the rise / fall thresholds of the service and the administrative
+// state of the target. The first check of a target decides its
+// initial state.
+func (m *Monitor) evaluateCheck(t config.Target, checkErr error) (inRotation bool) {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+
+	now := time.Now()
+
+	ts, known := m.status[t.String()]
+	if !known {
+		ts = &TargetStatus{Target: t.String(), Weight: t.Weight}
+		m.status[t.String()] = ts
+	}
+
+	ts.Healthy = checkErr == nil
+	ts.LastCheck = now
+	ts.LastError = ""
+	ts.FailedChecks = nil
+
+	if checkErr != nil {
+		ts.ConsecutiveFailures++
+		ts.ConsecutiveSuccesses = 0
+		ts.LastError = checkErr.Error()
+
+		var cErr *healthcheck.CheckError
+		if errors.As(checkErr, &cErr) {
+			ts.FailedChecks = cErr.Failed
+		}
+	} else {
+		ts.ConsecutiveFailures = 0
+		ts.ConsecutiveSuccesses++
+	}
+
+	var (
+		fall = m.svc.HealthCheck.FallThreshold()
+		rise = m.svc.HealthCheck.RiseThreshold()
+	)
+
+	switch {
+	case !known:
+		inRotation = ts.Healthy
+
+	case ts.InRotation && !ts.Healthy:
+		inRotation = ts.ConsecutiveFailures < fall
+
+	case !ts.InRotation && ts.Healthy:
+		inRotation = ts.ConsecutiveSuccesses >= rise
+
+	default:
+		inRotation = ts.InRotation
+	}
+
+	switch {
+	case inRotation && ts.Healthy:
+		ts.Reason = "check succeeded"
+	case inRotation:
+		ts.Reason = fmt.Sprintf("falling (%d/%d checks failed)", ts.ConsecutiveFailures, fall)
+	case ts.Healthy:
+		ts.Reason = fmt.Sprintf("rising (%d/%d checks succeeded)", ts.ConsecutiveSuccesses, rise)
+	default:
+		ts.Reason = "check failed"
+	}
+
+	if m.svc.OutlierDetection.Enabled {
+		inRotation = m.applyOutlierDetection(ts, inRotation, now)
+	}
+
+	if ts.AdminState = m.states.Get(m.svc.Name, t.String()); ts.AdminState != AdminStateEnabled {
+		inRotation = false
+		ts.Reason = ts.AdminState + " by operator"
+	}
+
+	if !known || ts.InRotation != inRotation {
+		ts.LastChange = now
+	}
+	ts.InRotation = inRotation
+
+	return inRotation
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+
+	"git.luzifer.io/luzifer/ipt-loadbalancer/pkg/backend"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	shutdownPolicyFreeze = "freeze"
+	shutdownPolicyLeave  = "leave"
+	shutdownPolicyRemove = "remove"
+)
+
+// shutdown applies the given policy to the rules after all monitors
+// were stopped: leave keeps the rules as they are, freeze re-adds the
+// last healthy targets to services without targets and remove deletes
+// all managed chains and the jumps to them
+func shutdown(be backend.Backend, policy string) error {
+	switch policy {
+	case shutdownPolicyFreeze:
+		if !be.RestoreLastKnownGood() {
+			return nil
+		}
+
+		logrus.Info("restoring last known good targets")
+		if err := be.EnsureManagedChains(); err != nil {
+			return fmt.Errorf("updating chains: %w", err)
+		}
+
+	case shutdownPolicyRemove:
+		logrus.Info("removing managed chains")
+		if err := be.Cleanup(); err != nil {
+			return fmt.Errorf("removing managed chains: %w", err)
+		}
+	}
+
+	return nil
+}